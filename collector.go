@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/Clever/kayvee-go.v6/logger"
 
@@ -10,35 +16,234 @@ import (
 	"github.com/Clever/ecs-task-metadata-exporter/metrics"
 )
 
+// builtinTaskLabels are the labels the collector applies to every metric about the task
+var builtinTaskLabels = []string{"Cluster", "TaskARN", "TaskDefinitionFamily", "TaskDefinitionRevision", "AvailabilityZone"}
+
+// builtinContainerLabels are the labels the collector applies to every container metric
+var builtinContainerLabels = append(append([]string{}, builtinTaskLabels...), "ContainerName")
+
+// CollectorOptions are optional settings for the collector. The zero value uses the defaults.
+type CollectorOptions struct {
+	// DockerLabels maps the keys of Docker labels to the Prometheus labels their values are applied to container metrics as.
+	// See ReservedLabelNames for the label names that can't be used.
+	DockerLabels metrics.LabelMapping
+	// TaskTags maps the keys of ECS task tags to the Prometheus labels their values are applied to all metrics as.
+	// If a task doesn't have a tag, the container instance's tag with the same key is used, if there is one.
+	// Tags are only available if the Source includes them, for example one from data.NewMetadataEndpointSourceWithTags.
+	TaskTags metrics.LabelMapping
+	// PerCPUMetrics enables metrics.PerCPUMetrics, which have a series for every CPU core of every container
+	PerCPUMetrics bool
+	// StaleGracePeriod is how long after data was last retrieved successfully the metrics from it are still reported if retrieving data fails.
+	// They are reported with ecs_container_exporter_data_stale set to 1. If it is 0, nothing but the exporter's own metrics are reported when retrieving data fails.
+	StaleGracePeriod time.Duration
+	// ExporterMetrics are reported along with the collector's own metrics about the exporter, and errors the collector encounters are recorded in them.
+	// If it is nil, the collector uses its own.
+	ExporterMetrics *ExporterMetrics
+}
+
+// ContextCollector is a prometheus.Collector that can also collect within the deadline of a context, such as a scrape's timeout
+type ContextCollector interface {
+	prometheus.Collector
+	// CollectContext is like Collect, but gives up retrieving data once ctx is done
+	CollectContext(ctx context.Context, ch chan<- prometheus.Metric)
+}
+
 type collector struct {
-	Source data.Source
-	Logger logger.KayveeLogger
+	Source  data.Source
+	Logger  logger.KayveeLogger
+	Options CollectorOptions
+	// TaskLabelNames are the labels of every metric about the task, including task tags.
+	// ContainerLabelNames are the labels of every container metric, which are the task's plus ContainerName and Docker labels.
+	// Labels that don't apply to a task or container are reported with empty values, which Prometheus treats as missing.
+	TaskLabelNames      []string
+	ContainerLabelNames []string
+	// MetadataMetrics are the metrics to report for every container, and StatsMetrics for containers that have stats
+	MetadataMetrics metrics.ContainerMetrics
+	StatsMetrics    metrics.ContainerMetrics
+	TaskMetrics     metrics.TaskMetrics
+	// The descriptors of the collector's metrics about the exporter
+	UpDesc             *prometheus.Desc
+	StaleDesc          *prometheus.Desc
+	ScrapeDurationDesc *prometheus.Desc
+	SnapshotAgeDesc    *prometheus.Desc
+	// LastGood is what was reported the last time data was retrieved successfully
+	LastGood *lastGood
+	// TagErrors are the errors retrieving tags that were last logged
+	TagErrors *tagErrors
 }
 
-// NewCollector returns a prometheus.Collector configured to collect Docker metrics
-func NewCollector(source data.Source, l logger.KayveeLogger) prometheus.Collector {
+// lastGood holds the metrics reported the last time data was retrieved successfully, so they can be reported again during the stale grace period
+type lastGood struct {
+	mu      sync.Mutex
+	metrics []prometheus.Metric
+	labels  prometheus.Labels
+	at      time.Time
+}
+
+// tagErrors remembers the errors retrieving tags that were last logged, so they're only logged again if they change.
+// ECS reports them on every request until the task role is fixed, which would otherwise be a warning every scrape.
+type tagErrors struct {
+	mu   sync.Mutex
+	last []string
+}
+
+// changed records errs as the current errors retrieving tags, and returns whether they're different from the last ones
+func (t *tagErrors) changed(errs []data.MetadataError) bool {
+	// The request ID and message can differ each time for the same problem, so they aren't compared
+	keys := make([]string, 0, len(errs))
+	for _, err := range errs {
+		keys = append(keys, err.ErrorField+" "+err.ErrorCode+" "+err.ResourceARN)
+	}
+	sort.Strings(keys)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	same := len(keys) == len(t.last)
+	for i := 0; same && i < len(keys); i++ {
+		same = keys[i] == t.last[i]
+	}
+	t.last = keys
+	return !same
+}
+
+// NewCollector returns a ContextCollector configured to collect Docker metrics.
+// It returns an error if options would give a metric the same label name more than once.
+func NewCollector(source data.Source, l logger.KayveeLogger, options CollectorOptions) (ContextCollector, error) {
 	// Set a logger with discarded output instead of nil, so we can call methods on log without panicing/checking for nil every time.
 	if l == nil {
 		l = logger.New("")
 		l.SetOutput(ioutil.Discard)
 	}
+	statsMetrics := metrics.DefaultMetrics
+	if options.PerCPUMetrics {
+		statsMetrics = append(append([]metrics.MetricConfig{}, metrics.DefaultMetrics...), metrics.PerCPUMetrics...)
+	}
+	if options.ExporterMetrics == nil {
+		options.ExporterMetrics = NewExporterMetrics()
+	}
+	taskLabelNames := append(append([]string{}, builtinTaskLabels...), sortedLabelNames(options.TaskTags)...)
+	containerLabelNames := append(append(append([]string{}, taskLabelNames...), "ContainerName"), sortedLabelNames(options.DockerLabels)...)
+	// Prometheus would only catch these when the collector is registered, which panics
+	for _, config := range append(append([]metrics.MetricConfig{}, metrics.DefaultMetadataMetrics...), statsMetrics...) {
+		if name, ok := duplicateLabelName(containerLabelNames, config.LabelNames); ok {
+			return nil, fmt.Errorf("label name %s is used more than once by %s", name, metrics.Prefix+config.Name)
+		}
+	}
+	for _, config := range metrics.DefaultTaskMetrics {
+		if name, ok := duplicateLabelName(taskLabelNames, config.LabelNames); ok {
+			return nil, fmt.Errorf("label name %s is used more than once by %s", name, metrics.TaskPrefix+config.Name)
+		}
+	}
 	return collector{
-		Source: source,
-		Logger: l,
+		Source:              source,
+		Logger:              l,
+		Options:             options,
+		TaskLabelNames:      taskLabelNames,
+		ContainerLabelNames: containerLabelNames,
+		MetadataMetrics:     metrics.NewContainerMetrics(metrics.DefaultMetadataMetrics, containerLabelNames),
+		StatsMetrics:        metrics.NewContainerMetrics(statsMetrics, containerLabelNames),
+		TaskMetrics:         metrics.NewTaskMetrics(metrics.DefaultTaskMetrics, taskLabelNames),
+		UpDesc:              prometheus.NewDesc(metrics.Prefix+"exporter_up", "1 if no issues were encountered during the scrape, 0 if errors occured", taskLabelNames, nil),
+		StaleDesc:           prometheus.NewDesc(metrics.Prefix+"exporter_data_stale", "1 if the other metrics are from an earlier scrape because retrieving data failed, 0 otherwise", taskLabelNames, nil),
+		ScrapeDurationDesc:  prometheus.NewDesc(metrics.Prefix+"exporter_scrape_duration_seconds", "Time taken to retrieve data and report metrics for the scrape", taskLabelNames, nil),
+		SnapshotAgeDesc:     prometheus.NewDesc(metrics.Prefix+"exporter_snapshot_age_seconds", "Time since the task metadata and stats being reported were retrieved", taskLabelNames, nil),
+		LastGood:            &lastGood{},
+		TagErrors:           &tagErrors{},
+	}, nil
+}
+
+// duplicateLabelName returns a label name that appears more than once across lists, if there is one
+func duplicateLabelName(lists ...[]string) (string, bool) {
+	seen := map[string]bool{}
+	for _, names := range lists {
+		for _, name := range names {
+			if seen[name] {
+				return name, true
+			}
+			seen[name] = true
+		}
 	}
+	return "", false
+}
+
+// sortedLabelNames returns the label names mapping maps onto, in a consistent order
+func sortedLabelNames(mapping metrics.LabelMapping) []string {
+	names := make([]string, 0, len(mapping))
+	for _, label := range mapping {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelValues returns the values of names in labels, in the same order, with an empty value for any that are missing
+func labelValues(names []string, labels prometheus.Labels) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return values
+}
+
+// ReservedLabelNames returns the names of the labels the collector already uses, which options can't add labels with
+func ReservedLabelNames() []string {
+	names := append([]string{}, builtinContainerLabels...)
+	names = append(names, metrics.VariableLabelNames(metrics.DefaultMetadataMetrics)...)
+	names = append(names, metrics.VariableLabelNames(metrics.DefaultMetrics)...)
+	names = append(names, metrics.VariableLabelNames(metrics.PerCPUMetrics)...)
+	for _, config := range metrics.DefaultTaskMetrics {
+		names = append(names, config.LabelNames...)
+	}
+	return names
 }
 
 func (c collector) Describe(ch chan<- *prometheus.Desc) {
-	// By construction, no metrics will ever change, but at describe time, we haven't inspected the metadata yet, so we don't have the full list
-	prometheus.DescribeByCollect(c, ch)
+	ch <- c.UpDesc
+	ch <- c.StaleDesc
+	ch <- c.ScrapeDurationDesc
+	if _, ok := c.Source.(data.Snapshotter); ok {
+		ch <- c.SnapshotAgeDesc
+	}
+	if _, ok := data.BreakerStateOf(c.Source); ok {
+		ch <- breakerStateDesc
+	}
+	c.MetadataMetrics.Describe(ch)
+	c.StatsMetrics.Describe(ch)
+	c.TaskMetrics.Describe(ch)
+	c.Options.ExporterMetrics.Describe(ch)
 }
 
 func (c collector) Collect(ch chan<- prometheus.Metric) {
-	meta, err := c.Source.Metadata()
+	c.CollectContext(context.Background(), ch)
+}
+
+func (c collector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	// The metadata and stats come from separate requests, so make them at the same time
+	var (
+		meta     data.TaskMetadata
+		stats    map[string]types.StatsJSON
+		statsErr error
+		wg       sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stats, statsErr = c.Source.Stats(ctx)
+	}()
+	meta, err := c.Source.Metadata(ctx)
+	wg.Wait()
+
+	// This is reported even if retrieving data failed, since that's when it's most interesting
+	if state, ok := data.BreakerStateOf(c.Source); ok {
+		c.collectBreakerState(state, ch)
+	}
+
 	if err != nil {
-		c.Logger.ErrorD("retrieving-metadata", logger.M{
+		c.logError("retrieving-metadata", logger.M{
 			"error": err.Error(),
 		})
+		c.collectStale(ch, nil, start)
 		return
 	}
 
@@ -51,23 +256,37 @@ func (c collector) Collect(ch chan<- prometheus.Metric) {
 	if meta.AvailabilityZone != nil {
 		commonLabels["AvailabilityZone"] = *meta.AvailabilityZone
 	}
-	statusDesc := prometheus.NewDesc(metrics.Prefix+"exporter_up", "1 if no issues were encountered during the scrape, 0 if errors occured", nil, commonLabels)
-
-	stats, err := c.Source.Stats()
-	if err != nil {
-		c.Logger.ErrorD("retrieving-stats", logger.M{
-			"error": err.Error(),
-		})
-		status, err := prometheus.NewConstMetric(statusDesc, prometheus.GaugeValue, 0.0)
-		if err != nil {
-			c.Logger.ErrorD("reporting-exporter-up-metric", logger.M{
-				"up": 0,
+	for key, label := range c.Options.TaskTags {
+		if v, ok := meta.TaskTags[key]; ok {
+			commonLabels[label] = v
+		} else if v, ok := meta.ContainerInstanceTags[key]; ok {
+			commonLabels[label] = v
+		}
+	}
+	if c.TagErrors.changed(meta.Errors) {
+		for _, metaErr := range meta.Errors {
+			// These are usually because the task role doesn't have permission to list tags, in which case the rest of the metadata is still there
+			c.Logger.WarnD("retrieving-tags", logger.M{
+				"field":        metaErr.ErrorField,
+				"code":         metaErr.ErrorCode,
+				"error":        metaErr.ErrorMessage,
+				"resource-arn": metaErr.ResourceARN,
 			})
-		} else {
-			ch <- status
 		}
+	}
+	if statsErr != nil {
+		c.logError("retrieving-stats", logger.M{
+			"error": statsErr.Error(),
+		})
+		c.collectStale(ch, commonLabels, start)
 		return
 	}
+	// Everything from here on is kept to report again if retrieving data fails later
+	var collected []prometheus.Metric
+	emit := func(m prometheus.Metric) {
+		collected = append(collected, m)
+		ch <- m
+	}
 	exporterIsUp := 1.0
 	for _, container := range meta.Containers {
 		// container.Type is used by ECS to distinguish containers internal to ECS from ones that are part of the task
@@ -80,13 +299,37 @@ func (c collector) Collect(ch chan<- prometheus.Metric) {
 			labels[k] = v
 		}
 		labels["ContainerName"] = container.Name
+		for key, label := range c.Options.DockerLabels {
+			if v, ok := container.Labels[key]; ok {
+				labels[label] = v
+			}
+		}
+		containerData := metrics.Container{
+			Metadata: container,
+			Task:     meta,
+		}
+		containerLabelValues := labelValues(c.ContainerLabelNames, labels)
+		metadataMetrics, err := c.MetadataMetrics.ToMetrics(containerData, containerLabelValues)
+		if err != nil {
+			c.logError("converting-metadata", logger.M{
+				"error": err.Error(),
+			})
+			exporterIsUp = 0.0
+		}
+		for _, m := range metadataMetrics {
+			emit(m)
+		}
+		if container.KnownStatus == "STOPPED" {
+			// Stopped containers don't have stats, but that's expected and their metadata metrics have already been reported
+			continue
+		}
 		containerStats, ok := stats[containerID]
 		if !ok {
 			containersInStats := []string{}
 			for k := range stats {
 				containersInStats = append(containersInStats, k)
 			}
-			c.Logger.ErrorD("missing-container", logger.M{
+			c.logError("missing-container", logger.M{
 				"missing":                containerID,
 				"containers-in-metadata": meta.Containers,
 				"containers-in-stats":    containersInStats,
@@ -94,25 +337,128 @@ func (c collector) Collect(ch chan<- prometheus.Metric) {
 			exporterIsUp = 0.0
 			continue
 		}
-		containerMetrics, err := metrics.StatsToMetrics(containerStats, metrics.DefaultMetrics, labels)
+		containerData.StatsJSON = containerStats
+		containerMetrics, err := c.StatsMetrics.ToMetrics(containerData, containerLabelValues)
 		if err != nil {
-			c.Logger.ErrorD("converting-stats", logger.M{
+			c.logError("converting-stats", logger.M{
 				"error": err.Error(),
 			})
 			exporterIsUp = 0.0
 			continue
 		}
 		for _, m := range containerMetrics {
-			ch <- m
+			emit(m)
 		}
 	}
-	status, err := prometheus.NewConstMetric(statusDesc, prometheus.GaugeValue, exporterIsUp)
+	taskMetrics, err := c.TaskMetrics.ToMetrics(metrics.Task{Metadata: meta, Stats: stats}, labelValues(c.TaskLabelNames, commonLabels))
+	if err != nil {
+		c.logError("converting-task-metrics", logger.M{
+			"error": err.Error(),
+		})
+		exporterIsUp = 0.0
+	}
+	for _, m := range taskMetrics {
+		emit(m)
+	}
+
+	c.LastGood.mu.Lock()
+	if c.Options.StaleGracePeriod > 0 {
+		c.LastGood.metrics = collected
+	}
+	c.LastGood.labels = commonLabels
+	c.LastGood.at = time.Now()
+	c.LastGood.mu.Unlock()
+	c.collectStatus(ch, commonLabels, exporterIsUp, 0.0, start)
+}
+
+// collectStale reports the metrics from the last time data was retrieved successfully if that was within the stale grace period, after retrieving data failed.
+// labels are the labels for the exporter's own metrics if data has never been retrieved successfully.
+func (c collector) collectStale(ch chan<- prometheus.Metric, labels prometheus.Labels, start time.Time) {
+	c.LastGood.mu.Lock()
+	if c.LastGood.labels != nil {
+		// Keep reporting the exporter's own metrics with the same labels, so they're the same series
+		labels = c.LastGood.labels
+	}
+	var staleMetrics []prometheus.Metric
+	if c.Options.StaleGracePeriod > 0 && time.Since(c.LastGood.at) <= c.Options.StaleGracePeriod {
+		staleMetrics = c.LastGood.metrics
+	}
+	c.LastGood.mu.Unlock()
+
+	stale := 0.0
+	if len(staleMetrics) > 0 {
+		stale = 1.0
+	}
+	for _, m := range staleMetrics {
+		ch <- m
+	}
+	c.collectStatus(ch, labels, 0.0, stale, start)
+}
+
+// collectStatus reports the exporter's own metrics, for a scrape that started at start
+func (c collector) collectStatus(ch chan<- prometheus.Metric, labels prometheus.Labels, up, stale float64, start time.Time) {
+	values := labelValues(c.TaskLabelNames, labels)
+	status, err := prometheus.NewConstMetric(c.UpDesc, prometheus.GaugeValue, up, values...)
 	if err != nil {
-		c.Logger.ErrorD("reporting-exporter-up-metric", logger.M{
-			"up": exporterIsUp,
+		c.logError("reporting-exporter-up-metric", logger.M{
+			"up": up,
 		})
 	} else {
 		ch <- status
 	}
+	staleMetric, err := prometheus.NewConstMetric(c.StaleDesc, prometheus.GaugeValue, stale, values...)
+	if err != nil {
+		c.logError("reporting-data-stale-metric", logger.M{
+			"stale": stale,
+		})
+	} else {
+		ch <- staleMetric
+	}
+	duration, err := prometheus.NewConstMetric(c.ScrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds(), values...)
+	if err != nil {
+		c.logError("reporting-scrape-duration-metric", logger.M{
+			"error": err.Error(),
+		})
+	} else {
+		ch <- duration
+	}
+	// This is reported when retrieving data fails too, since that's when the snapshot is getting old
+	if snapshotter, ok := c.Source.(data.Snapshotter); ok {
+		if at := snapshotter.SnapshotTime(); !at.IsZero() {
+			age, err := prometheus.NewConstMetric(c.SnapshotAgeDesc, prometheus.GaugeValue, time.Since(at).Seconds(), values...)
+			if err != nil {
+				c.logError("reporting-snapshot-age-metric", logger.M{
+					"error": err.Error(),
+				})
+			} else {
+				ch <- age
+			}
+		}
+	}
+	c.Options.ExporterMetrics.Collect(ch)
+}
+
+// logError logs an error, and records it in the exporter metrics by title
+func (c collector) logError(title string, fields logger.M) {
+	c.Logger.ErrorD(title, fields)
+	c.Options.ExporterMetrics.ObserveError(title)
+}
+
+var breakerStateDesc = prometheus.NewDesc(metrics.Prefix+"exporter_circuit_breaker_state", "1 for the current state of the circuit breaker in front of the ECS metadata endpoint, 0 for the others", []string{"State"}, nil)
 
+func (c collector) collectBreakerState(current data.BreakerState, ch chan<- prometheus.Metric) {
+	for _, state := range data.BreakerStates {
+		value := 0.0
+		if state == current {
+			value = 1.0
+		}
+		m, err := prometheus.NewConstMetric(breakerStateDesc, prometheus.GaugeValue, value, string(state))
+		if err != nil {
+			c.logError("reporting-circuit-breaker-state-metric", logger.M{
+				"error": err.Error(),
+			})
+			return
+		}
+		ch <- m
+	}
 }
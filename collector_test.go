@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/Clever/kayvee-go.v6/logger"
+
+	"github.com/Clever/ecs-task-metadata-exporter/data"
+	"github.com/Clever/ecs-task-metadata-exporter/metrics"
+)
+
+// fakeSource is a data.Source that returns the sample task metadata and stats, or Err if it is set
+type fakeSource struct {
+	mu       sync.Mutex
+	metadata data.TaskMetadata
+	stats    map[string]types.StatsJSON
+	Err      error
+}
+
+func newFakeSource(t *testing.T) *fakeSource {
+	s := &fakeSource{}
+	if err := json.Unmarshal(data.SampleTaskMetadata, &s.metadata); err != nil {
+		t.Fatalf("unmarshaling sample metadata: %v", err)
+	}
+	if err := json.Unmarshal(data.SampleTaskStats, &s.stats); err != nil {
+		t.Fatalf("unmarshaling sample stats: %v", err)
+	}
+	return s
+}
+
+func (s *fakeSource) SetErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+func (s *fakeSource) Metadata(ctx context.Context) (data.TaskMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metadata, s.Err
+}
+
+func (s *fakeSource) Stats(ctx context.Context) (map[string]types.StatsJSON, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats, s.Err
+}
+
+// gather collects the metrics from c, and returns them by name
+func gather(t *testing.T, c prometheus.Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("registering collector: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// gaugeValue returns the value of the only series of the gauge name in families, and its labels
+func gaugeValue(t *testing.T, families map[string]*dto.MetricFamily, name string) (float64, map[string]string) {
+	t.Helper()
+	family, ok := families[name]
+	if !ok {
+		t.Fatalf("%s wasn't reported", name)
+	}
+	if len(family.Metric) != 1 {
+		t.Fatalf("got %d series of %s; expecting 1", len(family.Metric), name)
+	}
+	labels := map[string]string{}
+	for _, pair := range family.Metric[0].Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return family.Metric[0].GetGauge().GetValue(), labels
+}
+
+func TestNewCollectorDuplicateLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		options  CollectorOptions
+		expected string
+	}{
+		{
+			name: "task tag and docker label",
+			options: CollectorOptions{
+				DockerLabels: metrics.LabelMapping{"team": "team"},
+				TaskTags:     metrics.LabelMapping{"team": "team"},
+			},
+			expected: "label name team is used more than once by ecs_container_start_time_seconds",
+		},
+		{
+			name:     "built-in label",
+			options:  CollectorOptions{TaskTags: metrics.LabelMapping{"cluster": "Cluster"}},
+			expected: "label name Cluster is used more than once by ecs_container_start_time_seconds",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewCollector(newFakeSource(t), nil, tc.options)
+			if err == nil {
+				t.Fatal("expected error from NewCollector()")
+			}
+			if diff := cmp.Diff(tc.expected, err.Error()); diff != "" {
+				t.Fatalf("error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorStaleGracePeriod(t *testing.T) {
+	const containerMetric = "ecs_container_mem_usage_bytes"
+	expectStatus := func(t *testing.T, families map[string]*dto.MetricFamily, up, stale float64, cluster string) {
+		t.Helper()
+		if value, labels := gaugeValue(t, families, "ecs_container_exporter_up"); value != up || labels["Cluster"] != cluster {
+			t.Fatalf("got exporter_up %v with cluster %q; expecting %v with cluster %q", value, labels["Cluster"], up, cluster)
+		}
+		if value, _ := gaugeValue(t, families, "ecs_container_exporter_data_stale"); value != stale {
+			t.Fatalf("got exporter_data_stale %v; expecting %v", value, stale)
+		}
+		if _, ok := families["ecs_container_exporter_scrape_duration_seconds"]; !ok {
+			t.Fatalf("ecs_container_exporter_scrape_duration_seconds wasn't reported")
+		}
+	}
+	newCollector := func(t *testing.T) (*fakeSource, collector) {
+		source := newFakeSource(t)
+		c, err := NewCollector(source, nil, CollectorOptions{StaleGracePeriod: time.Minute})
+		if err != nil {
+			t.Fatalf("got error from NewCollector(): %v", err)
+		}
+		return source, c.(collector)
+	}
+
+	t.Run("failure within grace period", func(t *testing.T) {
+		source, c := newCollector(t)
+		families := gather(t, c)
+		expectStatus(t, families, 1, 0, "default")
+		if _, ok := families[containerMetric]; !ok {
+			t.Fatalf("%s wasn't reported", containerMetric)
+		}
+
+		source.SetErr(errors.New("metadata endpoint unavailable"))
+		families = gather(t, c)
+		expectStatus(t, families, 0, 1, "default")
+		if _, ok := families[containerMetric]; !ok {
+			t.Fatalf("%s from the last successful scrape wasn't reported", containerMetric)
+		}
+	})
+
+	t.Run("failure after grace period", func(t *testing.T) {
+		source, c := newCollector(t)
+		gather(t, c)
+
+		source.SetErr(errors.New("metadata endpoint unavailable"))
+		c.LastGood.mu.Lock()
+		c.LastGood.at = c.LastGood.at.Add(-2 * time.Minute)
+		c.LastGood.mu.Unlock()
+		families := gather(t, c)
+		// The exporter's own metrics keep the labels from the last successful scrape, so they stay the same series
+		expectStatus(t, families, 0, 0, "default")
+		if _, ok := families[containerMetric]; ok {
+			t.Fatalf("%s was reported after the grace period", containerMetric)
+		}
+	})
+
+	t.Run("failure before any success", func(t *testing.T) {
+		source, c := newCollector(t)
+		source.SetErr(errors.New("metadata endpoint unavailable"))
+		families := gather(t, c)
+		expectStatus(t, families, 0, 0, "")
+		if _, ok := families[containerMetric]; ok {
+			t.Fatalf("%s was reported without any data", containerMetric)
+		}
+	})
+}
+
+// snapshotSource is a fakeSource that reports a snapshot time, like a data.PollingSource
+type snapshotSource struct {
+	*fakeSource
+	at time.Time
+}
+
+func (s *snapshotSource) SnapshotTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.at
+}
+
+func TestCollectorSnapshotAge(t *testing.T) {
+	const ageMetric = "ecs_container_exporter_snapshot_age_seconds"
+	source := &snapshotSource{fakeSource: newFakeSource(t)}
+	c, err := NewCollector(source, nil, CollectorOptions{})
+	if err != nil {
+		t.Fatalf("got error from NewCollector(): %v", err)
+	}
+
+	// Before the first refresh, there's no snapshot to report the age of
+	source.SetErr(errors.New("no snapshot yet"))
+	if _, ok := gather(t, c)[ageMetric]; ok {
+		t.Fatalf("%s was reported before there was a snapshot", ageMetric)
+	}
+
+	source.SetErr(nil)
+	source.mu.Lock()
+	source.at = time.Now()
+	source.mu.Unlock()
+	gather(t, c)
+
+	// Once the snapshot is too old to serve, its age should still be reported, with the same labels as before
+	source.SetErr(errors.New("snapshot is too old"))
+	source.mu.Lock()
+	source.at = time.Now().Add(-time.Hour)
+	source.mu.Unlock()
+	age, labels := gaugeValue(t, gather(t, c), ageMetric)
+	if age < time.Hour.Seconds() || labels["Cluster"] != "default" {
+		t.Fatalf("got %s %v with cluster %q; expecting at least %v with cluster default", ageMetric, age, labels["Cluster"], time.Hour.Seconds())
+	}
+}
+
+func TestCollectorLogsTagErrorsOnce(t *testing.T) {
+	source := newFakeSource(t)
+	source.metadata.Errors = []data.MetadataError{{
+		ErrorField:   "ContainerInstanceTags",
+		ErrorCode:    "AccessDeniedException",
+		ErrorMessage: "not authorized to perform ecs:ListTagsForResource",
+		ResourceARN:  "arn:aws:ecs:us-west-2:111122223333:container-instance/1f73d099-b914-411c-a9ff-81633b7741dd",
+	}}
+	var logs bytes.Buffer
+	l := logger.New("ecs-task-metadata-exporter")
+	l.SetOutput(&logs)
+	c, err := NewCollector(source, l, CollectorOptions{})
+	if err != nil {
+		t.Fatalf("got error from NewCollector(): %v", err)
+	}
+
+	collect := func() {
+		t.Helper()
+		logs.Reset()
+		gather(t, c)
+	}
+	logged := func() bool { return strings.Contains(logs.String(), "retrieving-tags") }
+
+	collect()
+	if !logged() {
+		t.Fatal("expected the error retrieving tags to be logged the first time")
+	}
+	collect()
+	if logged() {
+		t.Fatal("expected the same error retrieving tags not to be logged again")
+	}
+
+	// Once it's fixed, it's logged again if it comes back
+	source.metadata.Errors = nil
+	collect()
+	source.metadata.Errors = []data.MetadataError{{ErrorField: "TaskTags", ErrorCode: "AccessDeniedException"}}
+	collect()
+	if !logged() {
+		t.Fatal("expected a new error retrieving tags to be logged")
+	}
+}
@@ -0,0 +1,188 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Clever/ecs-task-metadata-exporter/metrics"
+)
+
+// Config is the exporter's configuration from a config file. Settings that aren't in the file are left as the zero value, so the defaults are used.
+type Config struct {
+	Port                string
+	AdditionalLogFields map[string]string
+	// MetadataURI is the ECS task metadata endpoint to use instead of detecting it from the environment
+	MetadataURI      string
+	IsLocal          bool
+	DockerLabels     metrics.LabelMapping
+	TaskTags         metrics.LabelMapping
+	PerCPUMetrics    bool
+	PollInterval     time.Duration
+	StaleGracePeriod time.Duration
+}
+
+// file is the format of the config file. JSON is parsed as YAML, which it is a subset of.
+// DockerLabels and TaskTags are lists of entries in the format of metrics.ParseLabelMapping, for example "app.version" or "com.mycorp.team=Team".
+type file struct {
+	Port                *int              `yaml:"port"`
+	AdditionalLogFields map[string]string `yaml:"additional_log_fields"`
+	MetadataURI         string            `yaml:"metadata_uri"`
+	IsLocal             bool              `yaml:"is_local"`
+	DockerLabels        []string          `yaml:"docker_labels"`
+	TaskTags            []string          `yaml:"task_tags"`
+	PerCPUMetrics       bool              `yaml:"per_cpu_metrics"`
+	PollInterval        string            `yaml:"poll_interval"`
+	StaleGracePeriod    string            `yaml:"stale_grace_period"`
+}
+
+// lineError matches the errors yaml reports for a line, for example "line 3: field foo not found in type config.file"
+var lineError = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Load reads and validates the config file at path. Unknown settings and invalid values are errors.
+// reserved are the label names that Docker labels and task tags can't be mapped onto.
+// If there are several problems, they are all reported, one per line, each prefixed with path and the line number it's on.
+func Load(path string, reserved []string) (Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("reading config file: %v", err)
+	}
+	return parse(path, b, reserved)
+}
+
+// parse is like Load, but parses a config file that has already been read. name is used in errors.
+func parse(name string, b []byte, reserved []string) (Config, error) {
+	type problem struct {
+		line    int
+		message string
+	}
+	var problems []problem
+
+	var f file
+	var root yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && err != io.EOF {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			// The file couldn't be parsed at all
+			return Config{}, errors.New(yamlError(name, err.Error()))
+		}
+		// The rest of the file was still decoded, so it can still be checked
+		for _, message := range typeErr.Errors {
+			line := 0
+			if match := lineError.FindStringSubmatch(message); match != nil {
+				line, _ = strconv.Atoi(match[1])
+			}
+			problems = append(problems, problem{line, yamlError(name, message)})
+		}
+	}
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return Config{}, errors.New(yamlError(name, err.Error()))
+	}
+
+	invalid := func(key, format string, args ...interface{}) {
+		line := keyLine(&root, key)
+		problems = append(problems, problem{line, fmt.Sprintf("%s:%d: %s: %s", name, line, key, fmt.Sprintf(format, args...))})
+	}
+
+	c := Config{
+		AdditionalLogFields: f.AdditionalLogFields,
+		MetadataURI:         f.MetadataURI,
+		IsLocal:             f.IsLocal,
+		PerCPUMetrics:       f.PerCPUMetrics,
+	}
+	if f.Port != nil {
+		if *f.Port < 1 || *f.Port > 65535 {
+			invalid("port", "must be from 1 to 65535, got %d", *f.Port)
+		} else {
+			c.Port = strconv.Itoa(*f.Port)
+		}
+	}
+	if f.DockerLabels != nil {
+		mapping, err := metrics.ParseLabelMapping(strings.Join(f.DockerLabels, ","), metrics.BuiltinLabels(reserved))
+		if err != nil {
+			invalid("docker_labels", "%v", err)
+		} else {
+			c.DockerLabels = mapping
+		}
+	}
+	if f.TaskTags != nil {
+		// Task tags can't collide with Docker labels either, since they both end up on container metrics
+		reservedForTags := metrics.BuiltinLabels(reserved).With(c.DockerLabels, "Docker label")
+		mapping, err := metrics.ParseLabelMapping(strings.Join(f.TaskTags, ","), reservedForTags)
+		if err != nil {
+			invalid("task_tags", "%v", err)
+		} else {
+			c.TaskTags = mapping
+		}
+	}
+	if f.PollInterval != "" {
+		interval, err := time.ParseDuration(f.PollInterval)
+		if err == nil && interval <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			invalid("poll_interval", "%v", err)
+		} else {
+			c.PollInterval = interval
+		}
+	}
+	if f.StaleGracePeriod != "" {
+		period, err := time.ParseDuration(f.StaleGracePeriod)
+		if err == nil && period < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			invalid("stale_grace_period", "%v", err)
+		} else {
+			c.StaleGracePeriod = period
+		}
+	}
+
+	if len(problems) > 0 {
+		// Report them in the order they appear in the file
+		sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+		messages := make([]string, 0, len(problems))
+		for _, p := range problems {
+			messages = append(messages, p.message)
+		}
+		return Config{}, errors.New(strings.Join(messages, "\n"))
+	}
+	return c, nil
+}
+
+// yamlError formats an error from parsing the config file named name as "name:line: message"
+func yamlError(name, message string) string {
+	if match := lineError.FindStringSubmatch(message); match != nil {
+		return fmt.Sprintf("%s:%s: %s", name, match[1], match[2])
+	}
+	return fmt.Sprintf("%s: %s", name, strings.TrimPrefix(message, "yaml: "))
+}
+
+// keyLine returns the line the top-level key is on in the parsed config file, or 0 if it isn't there
+func keyLine(root *yaml.Node, key string) int {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return 0
+	}
+	mapping := root.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return 0
+	}
+	// Mapping nodes alternate between keys and values
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i].Line
+		}
+	}
+	return 0
+}
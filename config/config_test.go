@@ -0,0 +1,120 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/Clever/ecs-task-metadata-exporter/metrics"
+)
+
+var reserved = []string{"Cluster", "ContainerName"}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		expected Config
+	}{
+		{
+			name: "yaml",
+			file: `
+port: 9100
+additional_log_fields:
+  team: infra
+docker_labels:
+  - com.mycorp.team=Team
+  - app.version
+task_tags: [environment]
+per_cpu_metrics: true
+poll_interval: 15s
+stale_grace_period: 5m
+`,
+			expected: Config{
+				Port:                "9100",
+				AdditionalLogFields: map[string]string{"team": "infra"},
+				DockerLabels:        metrics.LabelMapping{"com.mycorp.team": "Team", "app.version": "app_version"},
+				TaskTags:            metrics.LabelMapping{"environment": "environment"},
+				PerCPUMetrics:       true,
+				PollInterval:        15 * time.Second,
+				StaleGracePeriod:    5 * time.Minute,
+			},
+		},
+		{
+			name: "json",
+			file: `{"metadata_uri": "http://localhost:8912", "is_local": true}`,
+			expected: Config{
+				MetadataURI: "http://localhost:8912",
+				IsLocal:     true,
+			},
+		},
+		{
+			name:     "empty",
+			file:     ``,
+			expected: Config{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parse("config.yml", []byte(tc.file), reserved)
+			if err != nil {
+				t.Fatalf("got error from parse(): %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, c); diff != "" {
+				t.Fatalf("config mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{
+			name:     "syntax error",
+			file:     "port: 9100\n  per_cpu_metrics: true\n",
+			expected: "config.yml:2: mapping values are not allowed in this context",
+		},
+		{
+			name:     "unknown setting",
+			file:     "port: 9100\nper_cpu_metric: true\n",
+			expected: "config.yml:2: field per_cpu_metric not found in type config.file",
+		},
+		{
+			name:     "wrong type",
+			file:     "per_cpu_metrics: yes please\n",
+			expected: "config.yml:1: cannot unmarshal !!str `yes please` into bool",
+		},
+		{
+			name: "invalid values",
+			file: "port: 0\npoll_interval: 15\ndocker_labels: [team=Cluster]\n",
+			expected: "config.yml:1: port: must be from 1 to 65535, got 0\n" +
+				`config.yml:2: poll_interval: time: missing unit in duration "15"` + "\n" +
+				"config.yml:3: docker_labels: label name Cluster for team collides with built-in label",
+		},
+		{
+			name: "unknown setting and invalid value",
+			file: "{\n  \"docker_label\": [\"team\"],\n  \"stale_grace_period\": \"-1m\"\n}\n",
+			expected: "config.yml:2: field docker_label not found in type config.file\n" +
+				"config.yml:3: stale_grace_period: must not be negative",
+		},
+		{
+			name:     "task tag collides with docker label",
+			file:     "docker_labels: [team]\ntask_tags: [team]\n",
+			expected: "config.yml:2: task_tags: label name team for team collides with Docker label team",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parse("config.yml", []byte(tc.file), reserved)
+			if err == nil {
+				t.Fatal("expected error from parse()")
+			}
+			if diff := cmp.Diff(tc.expected, err.Error()); diff != "" {
+				t.Fatalf("error mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
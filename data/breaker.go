@@ -0,0 +1,123 @@
+package data
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker in front of the metadata endpoint
+type BreakerState string
+
+const (
+	// BreakerClosed means requests are being made as usual
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen means the endpoint kept failing, so requests are failing immediately without being made
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen means the endpoint has been left alone for a while, and a trial request is being made to see if it has recovered
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// BreakerStates are all the states a circuit breaker can be in
+var BreakerStates = []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+// Breaker is implemented by Sources that stop making requests to an endpoint that keeps failing
+type Breaker interface {
+	// BreakerState returns the current state of the circuit breaker
+	BreakerState() BreakerState
+}
+
+// BreakerStateOf returns the state of source's circuit breaker, looking through Sources that wrap another Source, such as PollingSource.
+// It returns false if there is no circuit breaker.
+func BreakerStateOf(source Source) (BreakerState, bool) {
+	for {
+		if b, ok := source.(Breaker); ok {
+			return b.BreakerState(), true
+		}
+		u, ok := source.(interface{ Unwrap() Source })
+		if !ok {
+			return "", false
+		}
+		source = u.Unwrap()
+	}
+}
+
+// errBreakerOpen is returned instead of making a request while the circuit breaker is open
+var errBreakerOpen = errors.New("not requesting the metadata endpoint because it has been failing (circuit breaker open)")
+
+// circuitBreaker opens after threshold consecutive failures, and lets a trial request through once it has been open for cooldown
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trialing bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     BreakerClosed,
+	}
+}
+
+// allow returns errBreakerOpen if a request shouldn't be made. Otherwise, the result of the request must be passed to record, or release called if there isn't one.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch b.state {
+	case BreakerOpen:
+		return errBreakerOpen
+	case BreakerHalfOpen:
+		// Only one trial request at a time
+		if b.trialing {
+			return errBreakerOpen
+		}
+		b.trialing = true
+	}
+	return nil
+}
+
+// record records whether a request allowed by allow failed
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialing = false
+	if !failed {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// release ends a request allowed by allow without a result, for example because the caller gave up on it.
+// That says nothing about whether the endpoint is working, so it doesn't count as a success or a failure.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialing = false
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		// The next request will be a trial
+		return BreakerHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	expectState := func(expected BreakerState) {
+		t.Helper()
+		if state := b.State(); state != expected {
+			t.Fatalf("got state %s; expecting %s", state, expected)
+		}
+	}
+	request := func(failed bool) {
+		t.Helper()
+		if err := b.allow(); err != nil {
+			t.Fatalf("got error from allow(): %v", err)
+		}
+		b.record(failed)
+	}
+
+	// A failure below the threshold is forgotten after a success
+	request(true)
+	request(false)
+	request(true)
+	expectState(BreakerClosed)
+
+	request(true)
+	expectState(BreakerOpen)
+	if err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("got error %v from allow() while open; expecting %v", err, errBreakerOpen)
+	}
+
+	// After the cooldown, a single trial request is let through
+	now = now.Add(time.Minute)
+	expectState(BreakerHalfOpen)
+	if err := b.allow(); err != nil {
+		t.Fatalf("got error from allow() for the trial request: %v", err)
+	}
+	if err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("got error %v from allow() during the trial request; expecting %v", err, errBreakerOpen)
+	}
+
+	// A trial that's given up on leaves it half open for another trial
+	b.release()
+	expectState(BreakerHalfOpen)
+	if err := b.allow(); err != nil {
+		t.Fatalf("got error from allow() for the trial request after release(): %v", err)
+	}
+
+	// A failed trial opens it again straight away
+	b.record(true)
+	expectState(BreakerOpen)
+
+	// A successful trial closes it
+	now = now.Add(time.Minute)
+	request(false)
+	expectState(BreakerClosed)
+}
@@ -1,22 +1,25 @@
 package data
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"sync/atomic"
 	"time"
 
-	"github.com/docker/engine/api/types"
+	"github.com/docker/docker/api/types"
 )
 
 // Source is an abstraction for a provider of task metadata + stats.
 // In practice, it'll be the ECS task metadata endpoint, but it can also be mocked out.
 type Source interface {
 	// Stats returns a map of DockerIDs to stats of the form returned by the Docker daemon's stats endpoint
-	Stats() (map[string]types.StatsJSON, error)
+	Stats(ctx context.Context) (map[string]types.StatsJSON, error)
 	// Metadata retrieves the metadata for the task
-	Metadata() (TaskMetadata, error)
+	Metadata(ctx context.Context) (TaskMetadata, error)
 }
 
 // TaskMetadata describes the response of `GET MetadataURI/task`
@@ -35,6 +38,31 @@ type TaskMetadata struct {
 	AvailabilityZone   *string // Only available on Fargate platform version 1.4.0
 	ExecutionStoppedAt time.Time
 	Containers         []ContainerMetadata
+
+	// The following are only available in v4
+	LaunchType      string // EC2 or FARGATE
+	PlatformFamily  string
+	PlatformVersion string
+	ServiceName     string // Omitted if the task isn't part of a service
+	VPCID           string
+
+	EphemeralStorageMetrics *EphemeralStorageMetrics // Only available on Fargate platform version 1.4.0 and later
+	ClockDrift              *ClockDrift              // Only available if the clock is being synchronized by Amazon Time Sync Service
+
+	// The following are only available from `GET MetadataURI/taskWithTags` in v4
+	TaskTags              map[string]string
+	ContainerInstanceTags map[string]string // Only available on EC2
+	Errors                []MetadataError   // Problems retrieving the tags, for example if the task role doesn't have permission to list them
+}
+
+// MetadataError describes a problem ECS had retrieving part of the task metadata, such as its tags
+type MetadataError struct {
+	ErrorField   string
+	ErrorCode    string
+	ErrorMessage string
+	StatusCode   int
+	RequestID    string
+	ResourceARN  string
 }
 
 // ContainerMetadata describes the response of `GET MetadataURI` which also appears as part of `GET MetadataURI/task`
@@ -53,7 +81,47 @@ type ContainerMetadata struct {
 	CreatedAt     time.Time
 	StartedAt     time.Time
 	Type          string
-	// TODO Networks
+	Networks      []Network
+	ExitCode      *int    // Only available once the container has exited
+	Health        *Health // Only available if the container has a health check
+	ContainerARN  string  // Only available in v4
+}
+
+// Health is the status of a container's health check, as part of ContainerMetadata.
+// Only available in v4 of the metadata endpoint.
+type Health struct {
+	Status      string // HEALTHY, UNHEALTHY or UNKNOWN
+	StatusSince time.Time
+	Output      string
+}
+
+// Network describes a network attachment of a container, as part of ContainerMetadata.
+// Only NetworkMode and IPv4Addresses are available in v3 of the metadata endpoint; the rest were added in v4, and only apply to awsvpc mode.
+type Network struct {
+	NetworkMode              string // For example awsvpc, bridge or host
+	IPv4Addresses            []string
+	IPv6Addresses            []string
+	AttachmentIndex          *int
+	MACAddress               string
+	IPv4SubnetCIDRBlock      string
+	IPv6SubnetCIDRBlock      string
+	SubnetGatewayIPv4Address string
+	PrivateDNSName           string
+	DomainNameServers        []string
+	DomainNameSearchList     []string
+}
+
+// EphemeralStorageMetrics is the usage of a Fargate task's ephemeral storage, as part of TaskMetadata
+type EphemeralStorageMetrics struct {
+	Utilized uint64 // MiB
+	Reserved uint64 // MiB
+}
+
+// ClockDrift describes how accurate the task's clock is, as part of TaskMetadata
+type ClockDrift struct {
+	ClockErrorBound            float64 // Milliseconds
+	ReferenceTimestamp         time.Time
+	ClockSynchronizationStatus string // SYNCHRONIZED or NOT_SYNCHRONIZED
 }
 
 // Limits is the limits of a container or the whole task
@@ -63,59 +131,213 @@ type Limits struct {
 	Memory *uint64
 }
 
-// NewMetadataEndpointSource constructs a Source from the base URI to use as if it is the ECS task metadata URI
+const (
+	// maxAttempts is how many times a request to the metadata endpoint is made before giving up, if it keeps failing in a way that could be transient
+	maxAttempts = 3
+	// baseBackoff is the longest wait before the first retry. It doubles for each retry after that, up to maxBackoff.
+	baseBackoff = 100 * time.Millisecond
+	maxBackoff  = time.Second
+	// breakerThreshold is how many requests in a row can fail, after retrying, before the circuit breaker opens
+	breakerThreshold = 5
+	// breakerCooldown is how long the circuit breaker stays open before letting a trial request through
+	breakerCooldown = 30 * time.Second
+)
+
+// NewMetadataEndpointSource constructs a Source from the base URI to use as if it is the ECS task metadata URI.
+// Requests that fail in a way that could be transient, such as a 5xx response or a reset connection, are retried with backoff.
+// If requests keep failing, a circuit breaker stops making them for a while; its state is available from BreakerStateOf.
 func NewMetadataEndpointSource(endpointURI string) Source {
+	return newMetadataEndpointSource(endpointURI, EndpointOptions{})
+}
+
+// NewMetadataEndpointSourceWithTags is like NewMetadataEndpointSource, but gets the task metadata from `GET MetadataURI/taskWithTags`, so it includes tags.
+// This is only supported by v4 of the metadata endpoint. If it isn't supported, it falls back to `GET MetadataURI/task`.
+func NewMetadataEndpointSourceWithTags(endpointURI string) Source {
+	return newMetadataEndpointSource(endpointURI, EndpointOptions{WithTags: true})
+}
+
+// RequestObserver is called after each request to the metadata endpoint, including retries, with the path requested, for example /task/stats.
+// statusCode is 0 if no response was received.
+type RequestObserver func(path string, statusCode int, duration time.Duration)
+
+// EndpointOptions are optional settings for NewMetadataEndpointSourceWithOptions. The zero value uses the defaults.
+type EndpointOptions struct {
+	// WithTags gets the task metadata with tags, like NewMetadataEndpointSourceWithTags
+	WithTags bool
+	// OnRequest, if not nil, is called after each request to the metadata endpoint
+	OnRequest RequestObserver
+}
+
+// NewMetadataEndpointSourceWithOptions is like NewMetadataEndpointSource, with optional settings
+func NewMetadataEndpointSourceWithOptions(endpointURI string, options EndpointOptions) Source {
+	return newMetadataEndpointSource(endpointURI, options)
+}
+
+func newMetadataEndpointSource(endpointURI string, options EndpointOptions) *metadataEndpointSource {
 	return &metadataEndpointSource{
-		Endpoint: endpointURI,
+		Endpoint:    endpointURI,
+		WithTags:    options.WithTags,
+		OnRequest:   options.OnRequest,
+		MaxAttempts: maxAttempts,
+		BaseBackoff: baseBackoff,
+		MaxBackoff:  maxBackoff,
+		breaker:     newCircuitBreaker(breakerThreshold, breakerCooldown),
+
+		tagsUnsupported: new(int32),
 	}
 }
 
 type metadataEndpointSource struct {
-	Endpoint string
+	Endpoint    string
+	WithTags    bool
+	OnRequest   RequestObserver
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	breaker *circuitBreaker
+	// tagsUnsupported is set to 1 once /taskWithTags has returned 404, so it isn't requested again
+	tagsUnsupported *int32
 }
 
-func (m metadataEndpointSource) Metadata() (TaskMetadata, error) {
+func (m metadataEndpointSource) BreakerState() BreakerState {
+	return m.breaker.State()
+}
+
+func (m metadataEndpointSource) Metadata(ctx context.Context) (TaskMetadata, error) {
 	var ret TaskMetadata
-	taskEndpoint := m.Endpoint + "/task"
-	resp, err := http.Get(taskEndpoint)
-	if err != nil {
-		return ret, fmt.Errorf("GET %s: %v", taskEndpoint, err)
+	if m.WithTags && atomic.LoadInt32(m.tagsUnsupported) == 0 {
+		err := m.get(ctx, "/taskWithTags", "task metadata with tags", &ret)
+		if err == nil {
+			return ret, nil
+		}
+		// Older ECS agents don't support /taskWithTags, which they report with a 4xx, so fall back to /task.
+		// Anything else, such as a 5xx while the agent restarts, is returned, since falling back would report metrics without the tag labels.
+		statusErr, ok := err.(statusCodeError)
+		if !ok || statusErr.StatusCode < 400 || statusErr.StatusCode >= 500 {
+			return ret, err
+		}
+		// If it isn't there at all, that won't change until the agent is upgraded, which restarts the task, so stop asking for it.
+		if statusErr.StatusCode == http.StatusNotFound {
+			atomic.StoreInt32(m.tagsUnsupported, 1)
+		}
+		ret = TaskMetadata{}
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	err := m.get(ctx, "/task", "task metadata", &ret)
+	return ret, err
+}
+
+func (m metadataEndpointSource) Stats(ctx context.Context) (map[string]types.StatsJSON, error) {
+	var ret map[string]types.StatsJSON
+	err := m.get(ctx, "/task/stats", "task stats", &ret)
+	return ret, err
+}
+
+// statusCodeError is returned when the metadata endpoint responds with a non-success status code
+type statusCodeError struct {
+	What       string
+	StatusCode int
+	Body       string
+}
+
+func (e statusCodeError) Error() string {
+	return fmt.Sprintf("got non-success status code %d from %s endpoint with response body: %s", e.StatusCode, e.What, e.Body)
+}
+
+// get requests path from the metadata endpoint and unmarshals the JSON response into v, giving up once ctx is done.
+// what describes the response for error messages.
+func (m metadataEndpointSource) get(ctx context.Context, path, what string, v interface{}) error {
+	if err := m.breaker.allow(); err != nil {
+		return err
+	}
+	body, err := m.getWithRetries(ctx, path, what)
+	if err != nil && ctx.Err() != nil {
+		// The caller gave up, for example because the scrape timed out, which isn't the endpoint's fault
+		m.breaker.release()
+		return err
+	}
+	// Only failures that mean the endpoint isn't working count towards opening the breaker.
+	// For example, a 404 from an older agent that doesn't support /taskWithTags means it's working fine.
+	m.breaker.record(err != nil && isTransient(err))
 	if err != nil {
-		return ret, fmt.Errorf("reading task metadata response body: %v", err)
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return ret, fmt.Errorf("got non-success status code %d from task metadata endpoint with response body: %s", resp.StatusCode, string(body))
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unmarshaling %s response json: %v", what, err)
 	}
+	return nil
+}
 
-	if err := json.Unmarshal(body, &ret); err != nil {
-		return ret, fmt.Errorf("unmarshaling task metadata response json: %v", err)
+// getWithRetries requests path from the metadata endpoint, retrying with jittered exponential backoff if it fails in a way that could be transient
+func (m metadataEndpointSource) getWithRetries(ctx context.Context, path, what string) ([]byte, error) {
+	backoff := m.BaseBackoff
+	for attempt := 1; ; attempt++ {
+		body, err := m.getOnce(ctx, path, what)
+		if err == nil || !isTransient(err) || attempt >= m.MaxAttempts {
+			return body, err
+		}
+		// Full jitter, so several exporters retrying against the same agent don't all retry at the same moment
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+		if backoff *= 2; backoff > m.MaxBackoff {
+			backoff = m.MaxBackoff
+		}
 	}
-	return ret, nil
 }
 
-func (m metadataEndpointSource) Stats() (map[string]types.StatsJSON, error) {
-	var ret map[string]types.StatsJSON
-	taskEndpoint := m.Endpoint + "/task/stats"
-	resp, err := http.Get(taskEndpoint)
+func (m metadataEndpointSource) getOnce(ctx context.Context, path, what string) ([]byte, error) {
+	endpoint := m.Endpoint + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
-		return ret, fmt.Errorf("GET %s: %v", taskEndpoint, err)
+		return nil, fmt.Errorf("creating request for %s: %v", endpoint, err)
+	}
+	start := time.Now()
+	statusCode := 0
+	if m.OnRequest != nil {
+		defer func() { m.OnRequest(path, statusCode, time.Since(start)) }()
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Giving up because ctx is done isn't worth retrying
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("GET %s: %v", endpoint, ctx.Err())
+		}
+		return nil, transientError{fmt.Errorf("GET %s: %v", endpoint, err)}
 	}
 	defer resp.Body.Close()
+	statusCode = resp.StatusCode
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return ret, fmt.Errorf("reading task stats response body: %v", err)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("reading %s response body: %v", what, ctx.Err())
+		}
+		return nil, transientError{fmt.Errorf("reading %s response body: %v", what, err)}
 	}
 	if resp.StatusCode != 200 {
-		return ret, fmt.Errorf("got non-success status code %d from task stats endpoint with response body: %s", resp.StatusCode, string(body))
+		return nil, statusCodeError{What: what, StatusCode: resp.StatusCode, Body: string(body)}
 	}
+	return body, nil
+}
+
+// transientError wraps an error from failing to get a response from the metadata endpoint, such as a reset connection
+type transientError struct {
+	error
+}
 
-	if err := json.Unmarshal(body, &ret); err != nil {
-		return ret, fmt.Errorf("unmarshaling task stats response json: %v", err)
+// isTransient returns whether err could go away if the request is retried
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case transientError:
+		return true
+	case statusCodeError:
+		return e.StatusCode >= 500
 	}
-	return ret, nil
+	return false
 }
 
 func constantHandler(body []byte) http.HandlerFunc {
@@ -1,11 +1,16 @@
 package data
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/docker/engine/api/types"
+	"github.com/docker/docker/api/types"
 	"github.com/go-openapi/swag"
 	"github.com/google/go-cmp/cmp"
 )
@@ -23,7 +28,7 @@ func TestMetadataEndpointSource(t *testing.T) {
 
 	m := NewMetadataEndpointSource("http://localhost:8912")
 
-	if meta, err := m.Metadata(); err != nil {
+	if meta, err := m.Metadata(context.Background()); err != nil {
 		t.Fatalf("got error from Metadata(): %v", err)
 	} else {
 		expectedMetadata := TaskMetadata{
@@ -56,6 +61,7 @@ func TestMetadataEndpointSource(t *testing.T) {
 					CreatedAt:     mustParseTime(time.RFC3339, "2018-02-01T20:55:08.366329616Z"),
 					StartedAt:     mustParseTime(time.RFC3339, "2018-02-01T20:55:09.058354915Z"),
 					Type:          "CNI_PAUSE",
+					Networks:      []Network{{NetworkMode: "awsvpc", IPv4Addresses: []string{"10.0.2.106"}}},
 				},
 				ContainerMetadata{
 					DockerID:   "43481a6ce4842eec8fe72fc28500c6b52edcc0917f105b83379f88cac1ff3946",
@@ -76,6 +82,7 @@ func TestMetadataEndpointSource(t *testing.T) {
 					CreatedAt:     mustParseTime(time.RFC3339, "2018-02-01T20:55:10.554941919Z"),
 					StartedAt:     mustParseTime(time.RFC3339, "2018-02-01T20:55:11.064236631Z"),
 					Type:          "NORMAL",
+					Networks:      []Network{{NetworkMode: "awsvpc", IPv4Addresses: []string{"10.0.2.106"}}},
 				},
 			},
 		}
@@ -84,7 +91,7 @@ func TestMetadataEndpointSource(t *testing.T) {
 		}
 	}
 
-	if stats, err := m.Stats(); err != nil {
+	if stats, err := m.Stats(context.Background()); err != nil {
 		t.Fatalf("got error from stats(): %v", err)
 	} else {
 		expectedStats := map[string]types.StatsJSON{
@@ -196,6 +203,314 @@ func TestMetadataEndpointSource(t *testing.T) {
 	}
 }
 
+func TestMetadataEndpointSourceWithTags(t *testing.T) {
+	t.Run("with tags", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.Handle("/taskWithTags", constantHandler([]byte(`{
+			"Cluster": "default",
+			"TaskTags": {"environment": "production"},
+			"Errors": [{
+				"ErrorField": "ContainerInstanceTags",
+				"ErrorCode": "AccessDeniedException",
+				"ErrorMessage": "not authorized to perform ecs:ListTagsForResource",
+				"StatusCode": 400,
+				"RequestId": "cd597ef0-272b-4643-9bd2-1de469870fa6",
+				"ResourceARN": "arn:aws:ecs:us-west-2:111122223333:container-instance/1f73d099-b914-411c-a9ff-81633b7741dd"
+			}]
+		}`)))
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		meta, err := NewMetadataEndpointSourceWithTags(server.URL).Metadata(context.Background())
+		if err != nil {
+			t.Fatalf("got error from Metadata(): %v", err)
+		}
+		expected := TaskMetadata{
+			Cluster:  "default",
+			TaskTags: map[string]string{"environment": "production"},
+			Errors: []MetadataError{{
+				ErrorField:   "ContainerInstanceTags",
+				ErrorCode:    "AccessDeniedException",
+				ErrorMessage: "not authorized to perform ecs:ListTagsForResource",
+				StatusCode:   400,
+				RequestID:    "cd597ef0-272b-4643-9bd2-1de469870fa6",
+				ResourceARN:  "arn:aws:ecs:us-west-2:111122223333:container-instance/1f73d099-b914-411c-a9ff-81633b7741dd",
+			}},
+		}
+		if diff := cmp.Diff(expected, meta); diff != "" {
+			t.Fatalf("metadata mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("falls back to /task", func(t *testing.T) {
+		// The constant handler doesn't serve /taskWithTags, like an ECS agent that doesn't support it
+		handler := ConstantMetadataEndpointHandler(SampleTaskMetadata, SampleTaskStats)
+		var tagsRequests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/taskWithTags" {
+				atomic.AddInt32(&tagsRequests, 1)
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		m := NewMetadataEndpointSourceWithTags(server.URL)
+		for i := 0; i < 3; i++ {
+			meta, err := m.Metadata(context.Background())
+			if err != nil {
+				t.Fatalf("got error from Metadata(): %v", err)
+			}
+			if meta.Cluster != "default" || meta.TaskTags != nil {
+				t.Fatalf("expected metadata from /task without tags, got cluster %q and tags %v", meta.Cluster, meta.TaskTags)
+			}
+		}
+		// Once it's known to be unsupported, /taskWithTags shouldn't be requested again
+		if requests := atomic.LoadInt32(&tagsRequests); requests != 1 {
+			t.Fatalf("got %d requests to /taskWithTags; expecting 1", requests)
+		}
+	})
+}
+
+func TestMetadataEndpointSourceWithTagsUnavailable(t *testing.T) {
+	// /taskWithTags fails the way it might while the ECS agent restarts, but /task still works
+	var tagsRequests int32
+	mux := http.NewServeMux()
+	mux.Handle("/task", constantHandler(SampleTaskMetadata))
+	mux.HandleFunc("/taskWithTags", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tagsRequests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	m := newMetadataEndpointSource(server.URL, EndpointOptions{WithTags: true})
+	m.BaseBackoff = time.Millisecond
+	m.MaxBackoff = time.Millisecond
+	for i := 0; i < 2; i++ {
+		// Falling back to /task would report metrics with the tag labels missing, so it should be an error instead
+		meta, err := m.Metadata(context.Background())
+		if err == nil {
+			t.Fatalf("expected error from Metadata(); got metadata with tags %v", meta.TaskTags)
+		}
+	}
+	// It isn't remembered as unsupported, since it could recover
+	if requests := atomic.LoadInt32(&tagsRequests); requests != 2*maxAttempts {
+		t.Fatalf("got %d requests to /taskWithTags; expecting %d", requests, 2*maxAttempts)
+	}
+}
+
+func TestMetadataEndpointSourceRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		failures         int
+		failureStatus    int
+		expectError      bool
+		expectedRequests int
+	}{
+		{name: "recovers after 5xx", failures: 2, failureStatus: http.StatusServiceUnavailable, expectError: false, expectedRequests: 3},
+		{name: "gives up after max attempts", failures: 10, failureStatus: http.StatusServiceUnavailable, expectError: true, expectedRequests: 3},
+		{name: "doesn't retry 4xx", failures: 10, failureStatus: http.StatusNotFound, expectError: true, expectedRequests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests++
+				failing := requests <= tc.failures
+				mu.Unlock()
+				if failing {
+					w.WriteHeader(tc.failureStatus)
+					return
+				}
+				w.Write(SampleTaskStats)
+			}))
+			defer server.Close()
+
+			var observed []int
+			m := newMetadataEndpointSource(server.URL, EndpointOptions{
+				OnRequest: func(path string, statusCode int, duration time.Duration) {
+					if path != "/task/stats" {
+						t.Errorf("observed request to %s; expecting /task/stats", path)
+					}
+					observed = append(observed, statusCode)
+				},
+			})
+			m.BaseBackoff = time.Millisecond
+			m.MaxBackoff = time.Millisecond
+			_, err := m.Stats(context.Background())
+			if tc.expectError != (err != nil) {
+				t.Fatalf("got error %v from Stats(); expecting error: %v", err, tc.expectError)
+			}
+			if requests != tc.expectedRequests {
+				t.Fatalf("got %d requests; expecting %d", requests, tc.expectedRequests)
+			}
+			// Every attempt should be observed, including retries
+			if len(observed) != tc.expectedRequests || observed[0] != tc.failureStatus {
+				t.Fatalf("observed status codes %v; expecting %d requests starting with %d", observed, tc.expectedRequests, tc.failureStatus)
+			}
+		})
+	}
+}
+
+func TestMetadataEndpointSourceBreaker(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	m := newMetadataEndpointSource(server.URL, EndpointOptions{})
+	m.MaxAttempts = 1
+	for i := 0; i < breakerThreshold; i++ {
+		if _, err := m.Stats(context.Background()); err == nil {
+			t.Fatal("expected error from Stats()")
+		}
+	}
+	// The state should be found through a Source wrapping this one, too
+	p := NewPollingSource(m, time.Hour, nil)
+	defer p.Stop()
+	if state, ok := BreakerStateOf(p); !ok || state != BreakerOpen {
+		t.Fatalf("got breaker state %q; expecting %s", state, BreakerOpen)
+	}
+
+	// While the breaker is open, no requests should be made
+	requestsWhenOpened := requests
+	if _, err := m.Stats(context.Background()); err != errBreakerOpen {
+		t.Fatalf("got error %v from Stats(); expecting %v", err, errBreakerOpen)
+	}
+	if requests != requestsWhenOpened {
+		t.Fatalf("made %d requests while the breaker was open", requests-requestsWhenOpened)
+	}
+}
+
+func TestMetadataEndpointSourceTimeout(t *testing.T) {
+	// An endpoint that hangs until the test is over
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	m := NewMetadataEndpointSource(server.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := m.Metadata(ctx); err == nil {
+		t.Fatal("expected error from Metadata() once the context timed out")
+	}
+	if _, err := m.Stats(ctx); err == nil {
+		t.Fatal("expected error from Stats() once the context timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("took %v to give up; expected it to stop at the context's deadline", elapsed)
+	}
+}
+
+func TestMetadataEndpointSourceCanceled(t *testing.T) {
+	// An endpoint that's healthy, but slower than the scrapes' timeouts
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		w.Write(SampleTaskStats)
+	}))
+	defer server.Close()
+	defer close(done)
+
+	m := newMetadataEndpointSource(server.URL, EndpointOptions{})
+	for i := 0; i < breakerThreshold+1; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := m.Stats(ctx)
+		cancel()
+		if err == nil {
+			t.Fatal("expected error from Stats() once the context timed out")
+		}
+		if isTransient(err) {
+			t.Fatalf("got transient error %v; expecting the context's error not to be retried", err)
+		}
+	}
+	// The scrapes giving up isn't the endpoint failing, so requests should still be made
+	if state := m.BreakerState(); state != BreakerClosed {
+		t.Fatalf("got breaker state %s after canceled requests; expecting %s", state, BreakerClosed)
+	}
+}
+
+func TestTaskMetadataV4(t *testing.T) {
+	// The fields only reported by v4 of the task metadata endpoint, as they are on Fargate
+	body := []byte(`{
+		"Cluster": "default",
+		"LaunchType": "FARGATE",
+		"PlatformFamily": "Linux",
+		"PlatformVersion": "1.4.0",
+		"ServiceName": "nginx-service",
+		"VPCID": "vpc-1234567890abcdef0",
+		"Containers": [{
+			"DockerId": "cd189a933e5849daa93386466019ab50-2495160603",
+			"Name": "nginx",
+			"ContainerARN": "arn:aws:ecs:us-west-2:111122223333:container/05966557-f16c-49cb-9352-24b3a0dcd0e1"
+		}]
+	}`)
+	var meta TaskMetadata
+	if err := json.Unmarshal(body, &meta); err != nil {
+		t.Fatalf("unmarshaling task metadata: %v", err)
+	}
+	expected := TaskMetadata{
+		Cluster:         "default",
+		LaunchType:      "FARGATE",
+		PlatformFamily:  "Linux",
+		PlatformVersion: "1.4.0",
+		ServiceName:     "nginx-service",
+		VPCID:           "vpc-1234567890abcdef0",
+		Containers: []ContainerMetadata{{
+			DockerID:     "cd189a933e5849daa93386466019ab50-2495160603",
+			Name:         "nginx",
+			ContainerARN: "arn:aws:ecs:us-west-2:111122223333:container/05966557-f16c-49cb-9352-24b3a0dcd0e1",
+		}},
+	}
+	if diff := cmp.Diff(expected, meta); diff != "" {
+		t.Fatalf("metadata mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkV4(t *testing.T) {
+	// A network attachment as reported by v4 of the task metadata endpoint in awsvpc mode
+	body := []byte(`{
+		"AttachmentIndex": 0,
+		"NetworkMode": "awsvpc",
+		"IPv4Addresses": ["192.0.2.3"],
+		"MACAddress": "0a:de:f6:10:51:e5",
+		"IPv4SubnetCIDRBlock": "192.0.2.0/24",
+		"DomainNameServers": ["192.0.2.2"],
+		"DomainNameSearchList": ["us-west-2.compute.internal"],
+		"PrivateDNSName": "ip-10-0-0-222.us-west-2.compute.internal",
+		"SubnetGatewayIpv4Address": "192.0.2.0/24"
+	}`)
+	var network Network
+	if err := json.Unmarshal(body, &network); err != nil {
+		t.Fatalf("unmarshaling network: %v", err)
+	}
+	expected := Network{
+		AttachmentIndex:          swag.Int(0),
+		NetworkMode:              "awsvpc",
+		IPv4Addresses:            []string{"192.0.2.3"},
+		MACAddress:               "0a:de:f6:10:51:e5",
+		IPv4SubnetCIDRBlock:      "192.0.2.0/24",
+		DomainNameServers:        []string{"192.0.2.2"},
+		DomainNameSearchList:     []string{"us-west-2.compute.internal"},
+		PrivateDNSName:           "ip-10-0-0-222.us-west-2.compute.internal",
+		SubnetGatewayIPv4Address: "192.0.2.0/24",
+	}
+	if diff := cmp.Diff(expected, network); diff != "" {
+		t.Fatalf("network mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func mustParseTime(layout, value string) time.Time {
 	t, err := time.Parse(layout, value)
 	if err != nil {
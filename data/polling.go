@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Snapshotter is implemented by Sources that serve a snapshot retrieved earlier, rather than retrieving data when asked for it
+type Snapshotter interface {
+	// SnapshotTime returns when the snapshot being served was retrieved, or the zero time if there isn't one yet
+	SnapshotTime() time.Time
+}
+
+// PollingSource is a Source that refreshes the metadata and stats from another Source in the background,
+// and serves the last snapshot of them that was retrieved successfully.
+type PollingSource struct {
+	source   Source
+	interval time.Duration
+	onError  func(error)
+	stop     chan struct{}
+
+	mu       sync.RWMutex
+	metadata TaskMetadata
+	stats    map[string]types.StatsJSON
+	updated  time.Time
+	// lastErr is the error from the last refresh, or nil if it succeeded
+	lastErr error
+}
+
+// maxSnapshotIntervals is how many intervals old a snapshot can get before it's no longer served.
+// Past that, refreshing has failed several times in a row, so errors are returned to let the collector report that the data is stale.
+const maxSnapshotIntervals = 3
+
+// NewPollingSource constructs a PollingSource that refreshes from source every interval, starting immediately.
+// onError, if not nil, is called with any error from refreshing. The snapshot being served is kept in that case,
+// until it is more than maxSnapshotIntervals intervals old.
+func NewPollingSource(source Source, interval time.Duration, onError func(error)) *PollingSource {
+	p := &PollingSource{
+		source:   source,
+		interval: interval,
+		onError:  onError,
+		stop:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Stop stops refreshing. The last snapshot will still be served until it is too old.
+func (p *PollingSource) Stop() {
+	close(p.stop)
+}
+
+func (p *PollingSource) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.refresh()
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *PollingSource) refresh() {
+	// Don't let a hung endpoint hold up the next refresh
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	// The metadata and stats come from separate requests, so make them at the same time
+	var (
+		stats    map[string]types.StatsJSON
+		statsErr error
+		wg       sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stats, statsErr = p.source.Stats(ctx)
+	}()
+	meta, err := p.source.Metadata(ctx)
+	wg.Wait()
+	if err != nil {
+		p.handleError(err)
+		return
+	}
+	if statsErr != nil {
+		p.handleError(statsErr)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metadata = meta
+	p.stats = stats
+	p.updated = time.Now()
+	p.lastErr = nil
+}
+
+func (p *PollingSource) handleError(err error) {
+	p.mu.Lock()
+	p.lastErr = err
+	p.mu.Unlock()
+	if p.onError != nil {
+		p.onError(err)
+	}
+}
+
+// errNoSnapshot is returned if data is asked for before the first successful refresh
+var errNoSnapshot = errors.New("no snapshot of the task metadata and stats has been retrieved yet")
+
+// snapshotErr returns an error if there is no snapshot to serve, either because there hasn't been a successful refresh yet, or the last one was too long ago.
+// p.mu must be held.
+func (p *PollingSource) snapshotErr() error {
+	if p.updated.IsZero() {
+		return errNoSnapshot
+	}
+	if age := time.Since(p.updated); age > maxSnapshotIntervals*p.interval {
+		err := fmt.Errorf("snapshot of the task metadata and stats is too old to serve, since it was retrieved %s ago", age.Round(time.Millisecond))
+		if p.lastErr != nil {
+			err = fmt.Errorf("%v: %v", err, p.lastErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Metadata returns the task metadata from the last successful refresh.
+// It doesn't block, so ctx is unused.
+func (p *PollingSource) Metadata(ctx context.Context) (TaskMetadata, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.snapshotErr(); err != nil {
+		return TaskMetadata{}, err
+	}
+	return p.metadata, nil
+}
+
+// Stats returns the task stats from the last successful refresh.
+// It doesn't block, so ctx is unused.
+func (p *PollingSource) Stats(ctx context.Context) (map[string]types.StatsJSON, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if err := p.snapshotErr(); err != nil {
+		return nil, err
+	}
+	return p.stats, nil
+}
+
+// SnapshotTime returns when the last successful refresh happened
+func (p *PollingSource) SnapshotTime() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.updated
+}
+
+// Unwrap returns the Source being polled
+func (p *PollingSource) Unwrap() Source {
+	return p.source
+}
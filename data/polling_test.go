@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// flakySource is a Source that fails once Fail is set
+type flakySource struct {
+	Source
+	mu   sync.Mutex
+	Fail bool
+}
+
+func (f *flakySource) Metadata(ctx context.Context) (TaskMetadata, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Fail {
+		return TaskMetadata{}, errors.New("metadata endpoint unavailable")
+	}
+	return f.Source.Metadata(ctx)
+}
+
+func (f *flakySource) Stats(ctx context.Context) (map[string]types.StatsJSON, error) {
+	return f.Source.Stats(ctx)
+}
+
+func TestPollingSource(t *testing.T) {
+	server := httptest.NewServer(ConstantMetadataEndpointHandler(SampleTaskMetadata, SampleTaskStats))
+	defer server.Close()
+
+	source := &flakySource{Source: NewMetadataEndpointSource(server.URL)}
+	errs := make(chan error, 100)
+	p := NewPollingSource(source, 50*time.Millisecond, func(err error) { errs <- err })
+	defer p.Stop()
+
+	// Wait for the first refresh
+	deadline := time.Now().Add(5 * time.Second)
+	for p.SnapshotTime().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the first snapshot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if meta, err := p.Metadata(context.Background()); err != nil || meta.Cluster != "default" {
+		t.Fatalf("got metadata with cluster %q and error %v; expecting cluster default", meta.Cluster, err)
+	}
+	if stats, err := p.Stats(context.Background()); err != nil || len(stats) != 1 {
+		t.Fatalf("got %d stats and error %v; expecting 1", len(stats), err)
+	}
+
+	// Once refreshing fails, the last snapshot should still be served
+	source.mu.Lock()
+	source.Fail = true
+	source.mu.Unlock()
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a refresh to fail")
+	}
+	snapshotTime := p.SnapshotTime()
+	if meta, err := p.Metadata(context.Background()); err != nil || meta.Cluster != "default" {
+		t.Fatalf("got metadata with cluster %q and error %v after failed refresh; expecting cluster default", meta.Cluster, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !p.SnapshotTime().Equal(snapshotTime) {
+		t.Fatalf("snapshot time changed from %s to %s even though refreshes are failing", snapshotTime, p.SnapshotTime())
+	}
+
+	// Once the snapshot is too old, it isn't served anymore, so that the data is reported as stale
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		_, err := p.Metadata(context.Background())
+		if err != nil {
+			if !strings.Contains(err.Error(), "metadata endpoint unavailable") {
+				t.Fatalf("got error %q; expecting it to include the error from refreshing", err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the snapshot to be too old to serve")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := p.Stats(context.Background()); err == nil {
+		t.Fatalf("expected error from Stats() once the snapshot is too old")
+	}
+	if age := time.Since(snapshotTime); age < maxSnapshotIntervals*50*time.Millisecond {
+		t.Fatalf("snapshot stopped being served after %s; expecting at least %s", age, maxSnapshotIntervals*50*time.Millisecond)
+	}
+}
+
+// slowSource is a Source whose Metadata and Stats each take delay
+type slowSource struct {
+	Source
+	delay time.Duration
+}
+
+func (s slowSource) Metadata(ctx context.Context) (TaskMetadata, error) {
+	time.Sleep(s.delay)
+	return s.Source.Metadata(ctx)
+}
+
+func (s slowSource) Stats(ctx context.Context) (map[string]types.StatsJSON, error) {
+	time.Sleep(s.delay)
+	return s.Source.Stats(ctx)
+}
+
+func TestPollingSourceConcurrentRefresh(t *testing.T) {
+	server := httptest.NewServer(ConstantMetadataEndpointHandler(SampleTaskMetadata, SampleTaskStats))
+	defer server.Close()
+
+	// Each request takes most of the interval, so the refresh only fits in it if they're made at the same time
+	errs := make(chan error, 100)
+	p := NewPollingSource(slowSource{Source: NewMetadataEndpointSource(server.URL), delay: 300 * time.Millisecond}, 500*time.Millisecond, func(err error) { errs <- err })
+	defer p.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.SnapshotTime().IsZero() {
+		select {
+		case err := <-errs:
+			t.Fatalf("got error from refreshing: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the first snapshot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
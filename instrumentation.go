@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Clever/ecs-task-metadata-exporter/metrics"
+)
+
+// errorStages are the titles of the errors the collector logs, which are reported as the stage label of ecs_container_exporter_errors_total.
+// They are reported as 0 before any have happened, so that increases can be alerted on.
+var errorStages = []string{
+	"retrieving-metadata",
+	"retrieving-stats",
+	"converting-metadata",
+	"missing-container",
+	"converting-stats",
+	"converting-task-metrics",
+	"refreshing-snapshot",
+}
+
+// ExporterMetrics are the metrics the exporter reports about itself, other than the ones the collector reports every scrape
+type ExporterMetrics struct {
+	requestDuration *prometheus.HistogramVec
+	responses       *prometheus.CounterVec
+	errors          *prometheus.CounterVec
+}
+
+// NewExporterMetrics constructs an ExporterMetrics with nothing observed yet
+func NewExporterMetrics() *ExporterMetrics {
+	e := &ExporterMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: metrics.Prefix + "exporter_source_request_duration_seconds",
+			Help: "Time taken by requests to the ECS metadata endpoint, including ones that failed",
+		}, []string{"endpoint"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metrics.Prefix + "exporter_source_responses_total",
+			Help: "Responses from the ECS metadata endpoint by HTTP status code",
+		}, []string{"endpoint", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metrics.Prefix + "exporter_errors_total",
+			Help: "Errors encountered by the exporter, by the stage they happened in",
+		}, []string{"stage"}),
+	}
+	for _, stage := range errorStages {
+		e.errors.WithLabelValues(stage)
+	}
+	return e
+}
+
+// ObserveRequest records a request to the ECS metadata endpoint. It can be used as a data.RequestObserver.
+func (e *ExporterMetrics) ObserveRequest(path string, statusCode int, duration time.Duration) {
+	e.requestDuration.WithLabelValues(path).Observe(duration.Seconds())
+	// No response means there's no status code to count, but the error will be counted once retrieving data gives up
+	if statusCode != 0 {
+		e.responses.WithLabelValues(path, strconv.Itoa(statusCode)).Inc()
+	}
+}
+
+// ObserveError records an error in the given stage, which should be the title it is logged with
+func (e *ExporterMetrics) ObserveError(stage string) {
+	e.errors.WithLabelValues(stage).Inc()
+}
+
+func (e *ExporterMetrics) Describe(ch chan<- *prometheus.Desc) {
+	e.requestDuration.Describe(ch)
+	e.responses.Describe(ch)
+	e.errors.Describe(ch)
+}
+
+func (e *ExporterMetrics) Collect(ch chan<- prometheus.Metric) {
+	e.requestDuration.Collect(ch)
+	e.responses.Collect(ch)
+	e.errors.Collect(ch)
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/Clever/kayvee-go.v6/logger"
 
+	"github.com/Clever/ecs-task-metadata-exporter/config"
 	"github.com/Clever/ecs-task-metadata-exporter/data"
+	"github.com/Clever/ecs-task-metadata-exporter/metrics"
 )
 
 // We can try to detect an ECS metadata endpoint from env vars starting with the newest supported version and descending down.
@@ -29,26 +36,66 @@ const defaultPort = "9659"
 var mainLogger = logger.New("ecs-task-metadata-exporter")
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML or JSON config file; environment variables override the settings in it")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [--config FILE]\n       %s [--config FILE] validate [FILE...]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "":
+	case "validate":
+		os.Exit(validate(*configPath, flag.Args()[1:]))
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Settings from the config file are the defaults, which environment variables override
+	var cfg config.Config
+	if *configPath != "" {
+		var err error
+		cfg, err = config.Load(*configPath, ReservedLabelNames())
+		if err != nil {
+			mainLogger.CriticalD("bad-config", logger.M{
+				"error":  err.Error(),
+				"config": *configPath,
+			})
+			os.Exit(1)
+		}
+	}
+
 	port := defaultPort
+	if cfg.Port != "" {
+		port = cfg.Port
+	}
 	if portStr, ok := os.LookupEnv("PORT"); ok {
 		port = portStr
 	}
-	if logFields, ok := os.LookupEnv("ADDITIONAL_LOG_FIELDS"); ok {
+	logFields := cfg.AdditionalLogFields
+	if logFieldsStr, ok := os.LookupEnv("ADDITIONAL_LOG_FIELDS"); ok {
 		var fields map[string]string
-		if err := json.Unmarshal([]byte(logFields), &fields); err != nil {
+		if err := json.Unmarshal([]byte(logFieldsStr), &fields); err != nil {
 			mainLogger.WarnD("bad-additional-log-fields", logger.M{
 				"error":                 fmt.Sprintf("decoding ADDITIONAL_LOG_FIELDS: %v", err),
-				"ADDITIONAL_LOG_FIELDS": logFields,
+				"ADDITIONAL_LOG_FIELDS": logFieldsStr,
 			})
 		} else {
-			for k, v := range fields {
-				mainLogger.AddContext(k, v)
-			}
+			logFields = fields
 		}
 	}
+	for k, v := range logFields {
+		mainLogger.AddContext(k, v)
+	}
+	if *configPath != "" {
+		mainLogger.InfoD("using-config", logger.M{
+			"config": *configPath,
+		})
+	}
 
 	var endpoint string
-	if os.Getenv("IS_LOCAL") != "" {
+	if os.Getenv("IS_LOCAL") != "" || cfg.IsLocal {
 		handler := data.ConstantMetadataEndpointHandler(
 			data.SampleTaskMetadata, data.SampleTaskStats,
 		)
@@ -65,24 +112,201 @@ func main() {
 			"uri":    endpoint,
 		})
 	} else {
-		endpoint = mustGetECSMetadataURI()
+		endpoint = mustGetECSMetadataURI(cfg.MetadataURI)
+	}
+	options := collectorOptions(cfg, os.LookupEnv)
+
+	exporterMetrics := NewExporterMetrics()
+	options.ExporterMetrics = exporterMetrics
+	s := data.NewMetadataEndpointSourceWithOptions(endpoint, data.EndpointOptions{
+		WithTags:  len(options.TaskTags) > 0,
+		OnRequest: exporterMetrics.ObserveRequest,
+	})
+	pollInterval := cfg.PollInterval
+	if pollIntervalStr, ok := os.LookupEnv("POLL_INTERVAL"); ok {
+		interval, err := time.ParseDuration(pollIntervalStr)
+		if err == nil && interval <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			mainLogger.WarnD("bad-poll-interval", logger.M{
+				"error":         fmt.Sprintf("parsing POLL_INTERVAL: %v", err),
+				"POLL_INTERVAL": pollIntervalStr,
+			})
+		} else {
+			pollInterval = interval
+		}
+	}
+	if pollInterval > 0 {
+		s = data.NewPollingSource(s, pollInterval, func(err error) {
+			mainLogger.ErrorD("refreshing-snapshot", logger.M{
+				"error": err.Error(),
+			})
+			exporterMetrics.ObserveError("refreshing-snapshot")
+		})
 	}
-	s := data.NewMetadataEndpointSource(endpoint)
 
-	c := NewCollector(s, mainLogger)
+	c, err := NewCollector(s, mainLogger, options)
+	if err != nil {
+		mainLogger.CriticalD("bad-collector-options", logger.M{
+			"error": err.Error(),
+		})
+		os.Exit(1)
+	}
 	reg := prometheus.NewRegistry()
-	reg.MustRegister(c)
+	reg.MustRegister(prometheus.NewGoCollector())
+	reg.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	if err := checkCollector(c); err != nil {
+		mainLogger.CriticalD("bad-collector", logger.M{
+			"error": err.Error(),
+		})
+		os.Exit(1)
+	}
 
 	promServerOpts := promhttp.HandlerOpts{
 		// Log errors from the http server to our main logger with title promhttp-error
 		ErrorLog: kayveePrintlnLogger{l: mainLogger, title: "promhttp-error"},
 	}
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promServerOpts))
+	http.Handle("/metrics", scrapeHandler(c, reg, promServerOpts))
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 
 	log.Println("ecs-task-metadata-exporter exited without error")
 }
 
+const (
+	// defaultScrapeTimeout is used when the scrape request doesn't say how long Prometheus will wait. It's Prometheus' default scrape_timeout.
+	defaultScrapeTimeout = 10 * time.Second
+	// scrapeTimeoutOffset is left out of the scrape timeout, so there's time to write the response before Prometheus gives up
+	scrapeTimeoutOffset = 500 * time.Millisecond
+)
+
+// scrapeTimeout returns how long a scrape can spend collecting, based on the X-Prometheus-Scrape-Timeout-Seconds header Prometheus sends
+func scrapeTimeout(r *http.Request) time.Duration {
+	timeout := defaultScrapeTimeout
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		seconds, err := strconv.ParseFloat(header, 64)
+		if err == nil && seconds <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			mainLogger.WarnD("bad-scrape-timeout", logger.M{
+				"error":                               fmt.Sprintf("parsing X-Prometheus-Scrape-Timeout-Seconds: %v", err),
+				"X-Prometheus-Scrape-Timeout-Seconds": header,
+			})
+		} else {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return timeout
+}
+
+// scrapeHandler serves the metrics from c along with the ones from static, giving up retrieving data once the scrape times out
+func scrapeHandler(c ContextCollector, static prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r))
+		defer cancel()
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(scrapeCollector{ctx: ctx, c: c})
+		promhttp.HandlerFor(prometheus.Gatherers{static, reg}, opts).ServeHTTP(w, r)
+	})
+}
+
+// checkCollector checks that the descriptors of c are valid and consistent with each other, the way registering it would.
+// The collector is registered anew for each scrape, since it collects within the scrape's timeout, but unchecked (see scrapeCollector),
+// so this is where any problem with its descriptors is found, once at startup.
+func checkCollector(c prometheus.Collector) error {
+	return prometheus.NewPedanticRegistry().Register(c)
+}
+
+// scrapeCollector collects from a ContextCollector within the context of a single scrape.
+// It's an unchecked collector, since it describes nothing, so registering it for every scrape doesn't describe and check the collector's descriptors again.
+// checkCollector checks them once at startup instead.
+type scrapeCollector struct {
+	ctx context.Context
+	c   ContextCollector
+}
+
+func (s scrapeCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (s scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.CollectContext(s.ctx, ch)
+}
+
+// collectorOptions returns the collector options from cfg, overridden by environment variables looked up with lookupEnv.
+// Invalid environment variables are ignored with a warning, like elsewhere.
+func collectorOptions(cfg config.Config, lookupEnv func(string) (string, bool)) CollectorOptions {
+	options := CollectorOptions{
+		DockerLabels:     cfg.DockerLabels,
+		TaskTags:         cfg.TaskTags,
+		PerCPUMetrics:    cfg.PerCPUMetrics,
+		StaleGracePeriod: cfg.StaleGracePeriod,
+	}
+	if dockerLabels, ok := lookupEnv("DOCKER_LABELS"); ok {
+		mapping, err := metrics.ParseLabelMapping(dockerLabels, metrics.BuiltinLabels(ReservedLabelNames()))
+		if err != nil {
+			mainLogger.WarnD("bad-docker-labels", logger.M{
+				"error":         fmt.Sprintf("parsing DOCKER_LABELS: %v", err),
+				"DOCKER_LABELS": dockerLabels,
+			})
+		} else {
+			options.DockerLabels = mapping
+		}
+	}
+	if taskTags, ok := lookupEnv("TASK_TAGS"); ok {
+		// Task tags can't collide with Docker labels either, since they both end up on container metrics
+		reserved := metrics.BuiltinLabels(ReservedLabelNames()).With(options.DockerLabels, "Docker label")
+		mapping, err := metrics.ParseLabelMapping(taskTags, reserved)
+		if err != nil {
+			mainLogger.WarnD("bad-task-tags", logger.M{
+				"error":     fmt.Sprintf("parsing TASK_TAGS: %v", err),
+				"TASK_TAGS": taskTags,
+			})
+		} else {
+			options.TaskTags = mapping
+		}
+	}
+
+	if perCPU, ok := lookupEnv("PER_CPU_METRICS"); ok {
+		enabled, err := strconv.ParseBool(perCPU)
+		if err != nil {
+			mainLogger.WarnD("bad-per-cpu-metrics", logger.M{
+				"error":           fmt.Sprintf("parsing PER_CPU_METRICS: %v", err),
+				"PER_CPU_METRICS": perCPU,
+			})
+		} else {
+			options.PerCPUMetrics = enabled
+		}
+	}
+
+	if gracePeriod, ok := lookupEnv("STALE_GRACE_PERIOD"); ok {
+		period, err := time.ParseDuration(gracePeriod)
+		if err == nil && period < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			mainLogger.WarnD("bad-stale-grace-period", logger.M{
+				"error":              fmt.Sprintf("parsing STALE_GRACE_PERIOD: %v", err),
+				"STALE_GRACE_PERIOD": gracePeriod,
+			})
+		} else {
+			options.StaleGracePeriod = period
+		}
+	}
+
+	// Task tags from the config file were only checked against the Docker labels in it, which DOCKER_LABELS can replace
+	reserved := metrics.BuiltinLabels(ReservedLabelNames()).With(options.DockerLabels, "Docker label")
+	if err := options.TaskTags.CheckReserved(reserved); err != nil {
+		mainLogger.WarnD("bad-task-tags", logger.M{
+			"error": fmt.Sprintf("checking task tags against DOCKER_LABELS: %v", err),
+		})
+		options.TaskTags = nil
+	}
+	return options
+}
+
 // kayveePrintlnLogger implements the prometheus.Logger interface using a kayvee logger.Logger
 type kayveePrintlnLogger struct {
 	title string
@@ -95,7 +319,8 @@ func (k kayveePrintlnLogger) Println(v ...interface{}) {
 	})
 }
 
-func mustGetECSMetadataURI() string {
+// mustGetECSMetadataURI returns the ECS metadata endpoint from the environment, or configured if the environment doesn't have one
+func mustGetECSMetadataURI(configured string) string {
 	if uri, ok := os.LookupEnv(ECSMetadataURIV4Var); ok {
 		mainLogger.InfoD("using-source", logger.M{
 			"source": "ECSMetadataURIV4",
@@ -110,5 +335,35 @@ func mustGetECSMetadataURI() string {
 		})
 		return uri
 	}
-	panic(fmt.Errorf("couldn't detect ECS metadata endpoint (tried env vars %s and %s)", ECSMetadataURIV4Var, ECSMetadataURIV3Var))
+	if configured != "" {
+		mainLogger.InfoD("using-source", logger.M{
+			"source": "config",
+			"uri":    configured,
+		})
+		return configured
+	}
+	panic(fmt.Errorf("couldn't detect ECS metadata endpoint (tried env vars %s and %s, and metadata_uri in the config file)", ECSMetadataURIV4Var, ECSMetadataURIV3Var))
+}
+
+// validate checks config files without running the exporter, and returns the exit code.
+// The file from --config is checked along with any given after the validate command. Environment variables aren't taken into account.
+func validate(configPath string, paths []string) int {
+	if configPath != "" {
+		paths = append([]string{configPath}, paths...)
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "validate: no config files given")
+		flag.Usage()
+		return 2
+	}
+	code := 0
+	for _, path := range paths {
+		if _, err := config.Load(path, ReservedLabelNames()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+		} else {
+			fmt.Printf("%s: ok\n", path)
+		}
+	}
+	return code
 }
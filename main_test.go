@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Clever/ecs-task-metadata-exporter/config"
+	"github.com/Clever/ecs-task-metadata-exporter/data"
+	"github.com/Clever/ecs-task-metadata-exporter/metrics"
+)
+
+func TestCollectorOptions(t *testing.T) {
+	cfg := config.Config{
+		DockerLabels:     metrics.LabelMapping{"com.mycorp.team": "Team"},
+		TaskTags:         metrics.LabelMapping{"team": "team"},
+		StaleGracePeriod: time.Minute,
+	}
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		expected CollectorOptions
+	}{
+		{
+			name: "config only",
+			expected: CollectorOptions{
+				DockerLabels:     metrics.LabelMapping{"com.mycorp.team": "Team"},
+				TaskTags:         metrics.LabelMapping{"team": "team"},
+				StaleGracePeriod: time.Minute,
+			},
+		},
+		{
+			name: "env overrides config",
+			env:  map[string]string{"TASK_TAGS": "environment", "PER_CPU_METRICS": "true", "STALE_GRACE_PERIOD": "5m"},
+			expected: CollectorOptions{
+				DockerLabels:     metrics.LabelMapping{"com.mycorp.team": "Team"},
+				TaskTags:         metrics.LabelMapping{"environment": "environment"},
+				PerCPUMetrics:    true,
+				StaleGracePeriod: 5 * time.Minute,
+			},
+		},
+		{
+			name: "invalid env is ignored",
+			env:  map[string]string{"DOCKER_LABELS": "my.cluster=Cluster", "STALE_GRACE_PERIOD": "-1m"},
+			expected: CollectorOptions{
+				DockerLabels:     metrics.LabelMapping{"com.mycorp.team": "Team"},
+				TaskTags:         metrics.LabelMapping{"team": "team"},
+				StaleGracePeriod: time.Minute,
+			},
+		},
+		{
+			// The task tags from the config file are only valid with the Docker labels from it
+			name: "docker labels from env collide with task tags from config",
+			env:  map[string]string{"DOCKER_LABELS": "team"},
+			expected: CollectorOptions{
+				DockerLabels:     metrics.LabelMapping{"team": "team"},
+				StaleGracePeriod: time.Minute,
+			},
+		},
+		{
+			name: "task tags from env collide with docker labels from config",
+			env:  map[string]string{"TASK_TAGS": "Team"},
+			expected: CollectorOptions{
+				DockerLabels:     metrics.LabelMapping{"com.mycorp.team": "Team"},
+				TaskTags:         metrics.LabelMapping{"team": "team"},
+				StaleGracePeriod: time.Minute,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lookupEnv := func(key string) (string, bool) {
+				value, ok := tc.env[key]
+				return value, ok
+			}
+			options := collectorOptions(cfg, lookupEnv)
+			if diff := cmp.Diff(tc.expected, options); diff != "" {
+				t.Fatalf("options mismatch (-want +got):\n%s", diff)
+			}
+			// Whatever the options end up as, they have to work
+			if _, err := NewCollector(hangingSource{}, nil, options); err != nil {
+				t.Fatalf("got error from NewCollector(): %v", err)
+			}
+		})
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		header   string
+		expected time.Duration
+	}{
+		{name: "no header", expected: defaultScrapeTimeout - scrapeTimeoutOffset},
+		{name: "valid", header: "5", expected: 5*time.Second - scrapeTimeoutOffset},
+		{name: "fractional", header: "2.5", expected: 2 * time.Second},
+		{name: "zero", header: "0", expected: defaultScrapeTimeout - scrapeTimeoutOffset},
+		{name: "negative", header: "-3", expected: defaultScrapeTimeout - scrapeTimeoutOffset},
+		{name: "garbage", header: "soon", expected: defaultScrapeTimeout - scrapeTimeoutOffset},
+		// The offset isn't subtracted if it would leave no time at all
+		{name: "below offset", header: "0.2", expected: 200 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.header != "" {
+				r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.header)
+			}
+			if timeout := scrapeTimeout(r); timeout != tc.expected {
+				t.Fatalf("got timeout %s; expecting %s", timeout, tc.expected)
+			}
+		})
+	}
+}
+
+// hangingSource is a data.Source that never responds, like a hung metadata endpoint
+type hangingSource struct{}
+
+func (hangingSource) Metadata(ctx context.Context) (data.TaskMetadata, error) {
+	<-ctx.Done()
+	return data.TaskMetadata{}, ctx.Err()
+}
+
+func (hangingSource) Stats(ctx context.Context) (map[string]types.StatsJSON, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestScrapeHandlerTimeout(t *testing.T) {
+	c, err := NewCollector(hangingSource{}, nil, CollectorOptions{})
+	if err != nil {
+		t.Fatalf("got error from NewCollector(): %v", err)
+	}
+	server := httptest.NewServer(scrapeHandler(c, prometheus.NewRegistry(), promhttp.HandlerOpts{}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	// Leaves 100ms for collecting after the offset
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.6")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("scraping: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("scrape took %s; expecting it to give up after the scrape timeout", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; expecting 200", resp.StatusCode)
+	}
+	if !regexp.MustCompile(`(?m)^ecs_container_exporter_up(\{.*\})? 0$`).Match(body) {
+		t.Fatalf("expected ecs_container_exporter_up 0 in response:\n%s", body)
+	}
+}
+
+// badCollector is a prometheus.Collector with an invalid descriptor
+type badCollector struct{}
+
+func (badCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("bad metric name", "A metric whose name isn't valid", nil, nil)
+}
+
+func (badCollector) Collect(ch chan<- prometheus.Metric) {}
+
+func TestCheckCollector(t *testing.T) {
+	c, err := NewCollector(hangingSource{}, nil, CollectorOptions{})
+	if err != nil {
+		t.Fatalf("got error from NewCollector(): %v", err)
+	}
+	if err := checkCollector(c); err != nil {
+		t.Fatalf("got error from checkCollector(): %v", err)
+	}
+	if err := checkCollector(badCollector{}); err == nil {
+		t.Fatal("expected error from checkCollector() for an invalid descriptor")
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// invalidLabelChars matches the characters that can't appear in a Prometheus label name
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// LabelMapping maps keys (for example Docker label keys) to the Prometheus label names their values are exported as
+type LabelMapping map[string]string
+
+// ReservedLabels maps label names that a LabelMapping can't use to what already uses them, which is described in errors
+type ReservedLabels map[string]string
+
+// BuiltinLabels returns ReservedLabels for the given built-in label names
+func BuiltinLabels(names []string) ReservedLabels {
+	reserved := ReservedLabels{}
+	for _, name := range names {
+		reserved[name] = "built-in label"
+	}
+	return reserved
+}
+
+// With returns a copy of r that also reserves the label names mapping maps onto, described as kind followed by the key, for example "Docker label team"
+func (r ReservedLabels) With(mapping LabelMapping, kind string) ReservedLabels {
+	reserved := ReservedLabels{}
+	for name, what := range r {
+		reserved[name] = what
+	}
+	for key, label := range mapping {
+		reserved[label] = kind + " " + key
+	}
+	return reserved
+}
+
+// ParseLabelMapping parses a comma-separated list of keys to map onto Prometheus labels.
+// Each key can be followed by =LabelName to choose the Prometheus label name; otherwise it's the key made Prometheus-safe by SanitizeLabelName.
+// For example, "com.mycorp.team=Team,app.version" maps com.mycorp.team to Team and app.version to app_version.
+// It's an error for a key to map to one of the reserved label names, or for two keys to map to the same label name.
+func ParseLabelMapping(s string, reserved ReservedLabels) (LabelMapping, error) {
+	mapping := LabelMapping{}
+	used := map[string]string{}
+	for name, what := range reserved {
+		used[name] = what
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, label := entry, SanitizeLabelName(entry)
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			key, label = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if label != SanitizeLabelName(label) {
+				return nil, fmt.Errorf("%q is not a valid Prometheus label name", label)
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", entry)
+		}
+		if strings.HasPrefix(label, "__") {
+			return nil, fmt.Errorf("label name %s for %s is reserved for Prometheus internal use", label, key)
+		}
+		if other, ok := used[label]; ok {
+			return nil, fmt.Errorf("label name %s for %s collides with %s", label, key, other)
+		}
+		used[label] = key
+		mapping[key] = label
+	}
+	return mapping, nil
+}
+
+// CheckReserved returns an error if m maps a key onto one of the reserved label names.
+// ParseLabelMapping already checks this, so it's for checking a mapping against labels that were decided on afterwards.
+func (m LabelMapping) CheckReserved(reserved ReservedLabels) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if other, ok := reserved[m[key]]; ok {
+			return fmt.Errorf("label name %s for %s collides with %s", m[key], key, other)
+		}
+	}
+	return nil
+}
+
+// SanitizeLabelName makes name a valid Prometheus label name, by replacing invalid characters with underscores.
+// If name starts with a digit, it's prefixed with an underscore.
+func SanitizeLabelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// VariableLabelNames returns the names of all the variable labels used by configs
+func VariableLabelNames(configs []MetricConfig) []string {
+	names := []string{}
+	for _, config := range configs {
+		names = append(names, config.LabelNames...)
+	}
+	return names
+}
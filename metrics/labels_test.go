@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_ParseLabelMapping(t *testing.T) {
+	reserved := BuiltinLabels([]string{"Cluster", "ContainerName"}).With(LabelMapping{"com.mycorp.team": "team"}, "Docker label")
+	for _, tc := range []struct {
+		name        string
+		input       string
+		expected    LabelMapping
+		expectedErr string
+	}{
+		{
+			name:     "sanitized and renamed keys",
+			input:    "com.mycorp.team=Team, app.version,9lives",
+			expected: LabelMapping{"com.mycorp.team": "Team", "app.version": "app_version", "9lives": "_9lives"},
+		},
+		{name: "empty", input: "", expected: LabelMapping{}},
+		{name: "collides with built-in label", input: "my.cluster=Cluster", expectedErr: "label name Cluster for my.cluster collides with built-in label"},
+		{name: "collides with other reserved label", input: "team", expectedErr: "label name team for team collides with Docker label com.mycorp.team"},
+		{name: "keys collide after sanitizing", input: "app.version,app-version", expectedErr: "label name app_version for app-version collides with app.version"},
+		{name: "invalid label name", input: "team=my-team", expectedErr: `"my-team" is not a valid Prometheus label name`},
+		{name: "reserved label name", input: "__name__", expectedErr: "label name __name__ for __name__ is reserved for Prometheus internal use"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mapping, err := ParseLabelMapping(tc.input, reserved)
+			if tc.expectedErr != "" {
+				if err == nil {
+					t.Fatalf("expected an error, got mapping %v", mapping)
+				}
+				if diff := cmp.Diff(tc.expectedErr, err.Error()); diff != "" {
+					t.Fatalf("error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error from ParseLabelMapping: %v", err)
+			}
+			if diff := cmp.Diff(tc.expected, mapping); diff != "" {
+				t.Fatalf("label mapping mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_LabelMappingCheckReserved(t *testing.T) {
+	reserved := BuiltinLabels([]string{"Cluster"}).With(LabelMapping{"com.mycorp.team": "team"}, "Docker label")
+	if err := (LabelMapping{"environment": "environment"}).CheckReserved(reserved); err != nil {
+		t.Fatalf("got error from CheckReserved(): %v", err)
+	}
+	err := LabelMapping{"environment": "environment", "team": "team"}.CheckReserved(reserved)
+	if err == nil {
+		t.Fatal("expected error from CheckReserved()")
+	}
+	if diff := cmp.Diff("label name team for team collides with Docker label com.mycorp.team", err.Error()); diff != "" {
+		t.Fatalf("error mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ecsStatuses are the statuses ECS reports for containers and tasks, in lifecycle order.
+// They're used to give a series for every status in state-set style metrics, even ones that don't currently apply.
+var ecsStatuses = []string{"NONE", "PULLED", "CREATED", "RESOURCES_PROVISIONED", "RUNNING", "STOPPED"}
+
+// healthStatuses are the statuses ECS reports for container health checks
+var healthStatuses = []string{"HEALTHY", "UNHEALTHY", "UNKNOWN"}
+
+// now is time.Now, but can be replaced in tests
+var now = time.Now
+
+// DefaultMetadataMetrics is a slice of default metrics to use that only depend on a container's ECS metadata.
+// Unlike DefaultMetrics, these can be reported for containers that don't have any stats, for example ones that have stopped.
+var DefaultMetadataMetrics = []MetricConfig{
+	{
+		Name:     "start_time_seconds",
+		Help:     "Time the container started, in seconds since the Unix epoch",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: func(c Container) []Sample { return timestamp(c.Metadata.StartedAt) },
+	},
+	{
+		Name:     "created_time_seconds",
+		Help:     "Time the container was created, in seconds since the Unix epoch",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: func(c Container) []Sample { return timestamp(c.Metadata.CreatedAt) },
+	},
+	{
+		Name:       "status",
+		Help:       "1 for the container's current known and desired status, and 0 for every other status",
+		Type:       prometheus.GaugeValue,
+		LabelNames: []string{"Status", "StatusType"},
+		ValuesFn:   func(c Container) []Sample { return statusSet(c.Metadata.KnownStatus, c.Metadata.DesiredStatus) },
+	},
+	{
+		Name:     "exit_code",
+		Help:     "Exit code of the container, if it has exited",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: exitCode,
+	},
+	{
+		Name:       "health_status",
+		Help:       "1 for the container's current health check status, and 0 for every other status",
+		Type:       prometheus.GaugeValue,
+		LabelNames: []string{"Status"},
+		ValuesFn:   healthStatus,
+	},
+	{
+		Name:     "health_status_age_seconds",
+		Help:     "Time since the container's health check status last changed",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: healthStatusAge,
+	},
+	{
+		Name: "network_info",
+		Help: "Always 1, with labels describing each network attachment of the container",
+		Type: prometheus.GaugeValue,
+		LabelNames: []string{
+			"AttachmentIndex", "NetworkMode", "IPv4Addresses", "IPv6Addresses", "MACAddress",
+			"IPv4SubnetCIDRBlock", "IPv6SubnetCIDRBlock", "SubnetGatewayIPv4Address", "PrivateDNSName",
+		},
+		ValuesFn: networkInfo,
+	},
+	{
+		Name:       "info",
+		Help:       "Always 1, with labels describing the container's image and identity",
+		Type:       prometheus.GaugeValue,
+		LabelNames: []string{"Image", "ImageID", "DockerName", "ContainerARN"},
+		ValuesFn: func(c Container) []Sample {
+			return []Sample{{
+				LabelValues: []string{c.Metadata.Image, c.Metadata.ImageID, c.Metadata.DockerName, c.Metadata.ContainerARN},
+				Value:       1.0,
+			}}
+		},
+	},
+}
+
+// timestamp gives t in seconds since the Unix epoch, or no samples if t isn't set
+func timestamp(t time.Time) []Sample {
+	if t.IsZero() {
+		return nil
+	}
+	return []Sample{{Value: float64(t.UnixNano()) / nanosecondsPerSecond}}
+}
+
+// exitCode gives the exit code of the container, or no samples if it hasn't exited
+func exitCode(c Container) []Sample {
+	if c.Metadata.ExitCode == nil {
+		return nil
+	}
+	return []Sample{{Value: float64(*c.Metadata.ExitCode)}}
+}
+
+// healthStatus gives a state-set of health check statuses labeled by Status, or no samples if the container has no health check
+func healthStatus(c Container) []Sample {
+	if c.Metadata.Health == nil {
+		return nil
+	}
+	return stateSet(healthStatuses, c.Metadata.Health.Status)
+}
+
+// healthStatusAge gives the time since the container's health check status last changed, or no samples if that isn't known
+func healthStatusAge(c Container) []Sample {
+	if c.Metadata.Health == nil || c.Metadata.Health.StatusSince.IsZero() {
+		return nil
+	}
+	return []Sample{{Value: now().Sub(c.Metadata.Health.StatusSince).Seconds()}}
+}
+
+// networkInfo gives an info-style sample for each of the container's network attachments.
+// Addresses are comma-separated if there are several, and labels for fields that weren't reported are left empty.
+func networkInfo(c Container) []Sample {
+	samples := make([]Sample, 0, len(c.Metadata.Networks))
+	for i, n := range c.Metadata.Networks {
+		// AttachmentIndex is only reported in v4, so fall back to the position in the list
+		attachmentIndex := i
+		if n.AttachmentIndex != nil {
+			attachmentIndex = *n.AttachmentIndex
+		}
+		samples = append(samples, Sample{
+			LabelValues: []string{
+				strconv.Itoa(attachmentIndex),
+				n.NetworkMode,
+				strings.Join(n.IPv4Addresses, ","),
+				strings.Join(n.IPv6Addresses, ","),
+				n.MACAddress,
+				n.IPv4SubnetCIDRBlock,
+				n.IPv6SubnetCIDRBlock,
+				n.SubnetGatewayIPv4Address,
+				n.PrivateDNSName,
+			},
+			Value: 1.0,
+		})
+	}
+	return samples
+}
+
+// statusSet gives a state-set of ECS statuses labeled by Status and StatusType (Known or Desired)
+func statusSet(known, desired string) []Sample {
+	return append(stateSet(ecsStatuses, known, "Known"), stateSet(ecsStatuses, desired, "Desired")...)
+}
+
+// stateSet gives a sample for every one of statuses with value 0, except for the current status which has value 1.
+// Each sample is labeled by the status, followed by labelValues.
+// If current isn't one of statuses, it's still reported, so statuses we don't know about don't silently disappear.
+func stateSet(statuses []string, current string, labelValues ...string) []Sample {
+	if current != "" && !contains(statuses, current) {
+		statuses = append(append([]string{}, statuses...), current)
+	}
+	samples := make([]Sample, 0, len(statuses))
+	for _, status := range statuses {
+		value := 0.0
+		if status == current {
+			value = 1.0
+		}
+		samples = append(samples, Sample{
+			LabelValues: append([]string{status}, labelValues...),
+			Value:       value,
+		})
+	}
+	return samples
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
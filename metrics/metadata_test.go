@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/Clever/ecs-task-metadata-exporter/data"
+)
+
+func Test_StatusSet(t *testing.T) {
+	samples := statusSet("RUNNING", "SOMETHING_NEW")
+	expected := []Sample{
+		{LabelValues: []string{"NONE", "Known"}, Value: 0},
+		{LabelValues: []string{"PULLED", "Known"}, Value: 0},
+		{LabelValues: []string{"CREATED", "Known"}, Value: 0},
+		{LabelValues: []string{"RESOURCES_PROVISIONED", "Known"}, Value: 0},
+		{LabelValues: []string{"RUNNING", "Known"}, Value: 1},
+		{LabelValues: []string{"STOPPED", "Known"}, Value: 0},
+		{LabelValues: []string{"NONE", "Desired"}, Value: 0},
+		{LabelValues: []string{"PULLED", "Desired"}, Value: 0},
+		{LabelValues: []string{"CREATED", "Desired"}, Value: 0},
+		{LabelValues: []string{"RESOURCES_PROVISIONED", "Desired"}, Value: 0},
+		{LabelValues: []string{"RUNNING", "Desired"}, Value: 0},
+		{LabelValues: []string{"STOPPED", "Desired"}, Value: 0},
+		// Statuses that aren't in the list of known statuses should still be reported
+		{LabelValues: []string{"SOMETHING_NEW", "Desired"}, Value: 1},
+	}
+	if diff := cmp.Diff(expected, samples); diff != "" {
+		t.Fatalf("status set mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Health(t *testing.T) {
+	since := time.Date(2020, 4, 6, 16, 0, 0, 0, time.UTC)
+	now = func() time.Time { return since.Add(90 * time.Second) }
+	defer func() { now = time.Now }()
+
+	c := Container{Metadata: data.ContainerMetadata{
+		Health: &data.Health{Status: "UNHEALTHY", StatusSince: since},
+	}}
+	expectedStatus := []Sample{
+		{LabelValues: []string{"HEALTHY"}, Value: 0},
+		{LabelValues: []string{"UNHEALTHY"}, Value: 1},
+		{LabelValues: []string{"UNKNOWN"}, Value: 0},
+	}
+	if diff := cmp.Diff(expectedStatus, healthStatus(c)); diff != "" {
+		t.Fatalf("health status mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Sample{{Value: 90}}, healthStatusAge(c)); diff != "" {
+		t.Fatalf("health status age mismatch (-want +got):\n%s", diff)
+	}
+
+	// Containers without a health check shouldn't have health metrics
+	if samples := healthStatus(Container{}); len(samples) != 0 {
+		t.Fatalf("got health status %v for container without a health check", samples)
+	}
+}
+
+func Test_ContainerInfo(t *testing.T) {
+	var info MetricConfig
+	for _, config := range DefaultMetadataMetrics {
+		if config.Name == "info" {
+			info = config
+		}
+	}
+	c := Container{Metadata: data.ContainerMetadata{
+		Image:        "nginx:latest",
+		ImageID:      "sha256:2b3aa3ea1d7d5a5a2b0e3e1d7c0b2a1f0e0c9b8a7f6e5d4c3b2a1f0e9d8c7b6a",
+		DockerName:   "ecs-nginx-5-nginx-curl-ccccb9f49db0dfe0d901",
+		ContainerARN: "arn:aws:ecs:us-west-2:111122223333:container/05966557-f16c-49cb-9352-24b3a0dcd0e1",
+	}}
+	expected := []Sample{{
+		LabelValues: []string{
+			"nginx:latest",
+			"sha256:2b3aa3ea1d7d5a5a2b0e3e1d7c0b2a1f0e0c9b8a7f6e5d4c3b2a1f0e9d8c7b6a",
+			"ecs-nginx-5-nginx-curl-ccccb9f49db0dfe0d901",
+			"arn:aws:ecs:us-west-2:111122223333:container/05966557-f16c-49cb-9352-24b3a0dcd0e1",
+		},
+		Value: 1,
+	}}
+	if diff := cmp.Diff(expected, info.ValuesFn(c)); diff != "" {
+		t.Fatalf("container info mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -2,20 +2,56 @@ package metrics
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
-	"github.com/docker/engine/api/types"
+	"github.com/docker/docker/api/types"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Clever/ecs-task-metadata-exporter/data"
 )
 
 // Prefix will be prepended to all metrics so that they can be distinguished from similar metrics coming from other sources
 const Prefix = "ecs_container_"
 
-// MetricConfig is a specification of a single metric that can be extracted from the docker stats
+// Docker reports CPU times in nanoseconds, but Prometheus convention is to use seconds
+const nanosecondsPerSecond = 1e9
+
+// ECS container CPU limits are given in CPU units, of which there are 1024 per vCPU
+const cpuUnitsPerVCPU = 1024
+
+// minCPUShares is the fewest CPU shares Docker gives a container, which is what it has if no CPU limit was set
+const minCPUShares = 2.0
+
+// ECS memory limits are given in MiB
+const bytesPerMiB = 1024 * 1024
+
+// Container is everything known about a single container at scrape time: its docker stats, plus the ECS metadata of the container and of its task
+type Container struct {
+	types.StatsJSON
+	Metadata data.ContainerMetadata
+	Task     data.TaskMetadata
+}
+
+// MetricConfig is a specification of a single metric that can be extracted from a container's docker stats and ECS metadata.
+// Exactly one of ValueFn or ValuesFn should be set.
 type MetricConfig struct {
 	Name    string
 	Help    string
 	Type    prometheus.ValueType
-	ValueFn func(types.StatsJSON) float64
+	ValueFn func(Container) float64
+	// LabelNames are the variable labels of a metric that produces several samples, in the order their values appear in Sample.LabelValues
+	LabelNames []string
+	// ValuesFn returns one Sample per combination of LabelNames values, for metrics that can't be expressed by a single ValueFn.
+	// It can also return no samples, to leave out a metric that isn't applicable to the container.
+	ValuesFn func(Container) []Sample
+}
+
+// Sample is a single value of a metric along with the values of its variable labels
+type Sample struct {
+	LabelValues []string
+	Value       float64
 }
 
 // DefaultMetrics is a slice of default metrics to use
@@ -24,19 +60,79 @@ var DefaultMetrics = []MetricConfig{
 		Name:    "mem_usage_bytes",
 		Help:    "Current memory usage",
 		Type:    prometheus.GaugeValue,
-		ValueFn: func(s types.StatsJSON) float64 { return float64(s.MemoryStats.Usage) },
+		ValueFn: func(c Container) float64 { return float64(c.MemoryStats.Usage) },
 	},
 	{
 		Name:    "mem_max_usage_bytes",
 		Help:    "Maximum memory usage",
 		Type:    prometheus.GaugeValue,
-		ValueFn: func(s types.StatsJSON) float64 { return float64(s.MemoryStats.MaxUsage) },
+		ValueFn: func(c Container) float64 { return float64(c.MemoryStats.MaxUsage) },
 	},
 	{
 		Name:    "mem_limit_bytes",
 		Help:    "Memory limit",
 		Type:    prometheus.GaugeValue,
-		ValueFn: func(s types.StatsJSON) float64 { return float64(s.MemoryStats.Limit) },
+		ValueFn: func(c Container) float64 { return float64(c.MemoryStats.Limit) },
+	},
+	{
+		Name:     "declared_mem_limit_bytes",
+		Help:     "Memory limit of the container from the ECS task definition",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: declaredMemLimit,
+	},
+	{
+		Name:     "mem_utilization_of_limit",
+		Help:     "Memory working set of the container as a ratio of its ECS memory limit, or the task's if the container has none",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: memUtilizationOfLimit,
+	},
+	{
+		Name:    "mem_rss_bytes",
+		Help:    "Anonymous memory (heap, stack, etc.) in use",
+		Type:    prometheus.GaugeValue,
+		ValueFn: memStat("total_rss", "rss", "anon"),
+	},
+	{
+		Name:    "mem_cache_bytes",
+		Help:    "Page cache memory, including memory-mapped files and tmpfs",
+		Type:    prometheus.GaugeValue,
+		ValueFn: memStat("total_cache", "cache", "file"),
+	},
+	{
+		Name:    "mem_mapped_file_bytes",
+		Help:    "Memory-mapped files",
+		Type:    prometheus.GaugeValue,
+		ValueFn: memStat("total_mapped_file", "mapped_file", "file_mapped"),
+	},
+	{
+		Name:    "mem_inactive_file_bytes",
+		Help:    "Page cache memory on the inactive LRU list, which can be reclaimed under memory pressure",
+		Type:    prometheus.GaugeValue,
+		ValueFn: memStat("total_inactive_file", "inactive_file"),
+	},
+	{
+		Name:    "mem_active_anon_bytes",
+		Help:    "Anonymous memory on the active LRU list",
+		Type:    prometheus.GaugeValue,
+		ValueFn: memStat("total_active_anon", "active_anon"),
+	},
+	{
+		Name:    "mem_pgfault_total",
+		Help:    "Page faults",
+		Type:    prometheus.CounterValue,
+		ValueFn: memStat("total_pgfault", "pgfault"),
+	},
+	{
+		Name:    "mem_pgmajfault_total",
+		Help:    "Major page faults",
+		Type:    prometheus.CounterValue,
+		ValueFn: memStat("total_pgmajfault", "pgmajfault"),
+	},
+	{
+		Name:    "mem_working_set_bytes",
+		Help:    "Memory usage minus inactive page cache, the memory that can't be reclaimed under memory pressure",
+		Type:    prometheus.GaugeValue,
+		ValueFn: memWorkingSet,
 	},
 	{
 		Name:    "cpu_usage",
@@ -44,20 +140,222 @@ var DefaultMetrics = []MetricConfig{
 		Type:    prometheus.GaugeValue,
 		ValueFn: cpuUsage,
 	},
+	{
+		Name:    "cpu_usage_vcpus",
+		Help:    "Number of vCPUs' worth of CPU time being used by the container",
+		Type:    prometheus.GaugeValue,
+		ValueFn: cpuUsageVCPUs,
+	},
+	{
+		Name:     "cpu_utilization_of_limit",
+		Help:     "CPU usage of the container as a ratio of its ECS CPU limit, or the task's if the container has none",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: cpuUtilizationOfLimit,
+	},
+	{
+		Name:    "cpu_seconds_total",
+		Help:    "Total CPU time consumed by the container",
+		Type:    prometheus.CounterValue,
+		ValueFn: func(c Container) float64 { return float64(c.CPUStats.CPUUsage.TotalUsage) / nanosecondsPerSecond },
+	},
+	{
+		Name: "cpu_user_seconds_total",
+		Help: "CPU time consumed by the container in user mode",
+		Type: prometheus.CounterValue,
+		ValueFn: func(c Container) float64 {
+			return float64(c.CPUStats.CPUUsage.UsageInUsermode) / nanosecondsPerSecond
+		},
+	},
+	{
+		Name: "cpu_kernel_seconds_total",
+		Help: "CPU time consumed by the container in kernel mode",
+		Type: prometheus.CounterValue,
+		ValueFn: func(c Container) float64 {
+			return float64(c.CPUStats.CPUUsage.UsageInKernelmode) / nanosecondsPerSecond
+		},
+	},
+	{
+		Name:    "cpu_throttling_periods_total",
+		Help:    "Number of CPU enforcement periods that elapsed while the container had runnable work",
+		Type:    prometheus.CounterValue,
+		ValueFn: func(c Container) float64 { return float64(c.CPUStats.ThrottlingData.Periods) },
+	},
+	{
+		Name:    "cpu_throttled_periods_total",
+		Help:    "Number of CPU enforcement periods in which the container hit its CPU limit and was throttled",
+		Type:    prometheus.CounterValue,
+		ValueFn: func(c Container) float64 { return float64(c.CPUStats.ThrottlingData.ThrottledPeriods) },
+	},
+	{
+		Name: "cpu_throttled_seconds_total",
+		Help: "Total time the container was throttled for",
+		Type: prometheus.CounterValue,
+		ValueFn: func(c Container) float64 {
+			return float64(c.CPUStats.ThrottlingData.ThrottledTime) / nanosecondsPerSecond
+		},
+	},
+	{
+		Name:    "cpu_throttled_ratio",
+		Help:    "Fraction from 0 to 1 of CPU enforcement periods in which the container was throttled, in a short interval before the scrape",
+		Type:    prometheus.GaugeValue,
+		ValueFn: cpuThrottledRatio,
+	},
+	{
+		Name:    "pids_current",
+		Help:    "Number of processes and threads in the container",
+		Type:    prometheus.GaugeValue,
+		ValueFn: func(c Container) float64 { return float64(c.PidsStats.Current) },
+	},
+	{
+		Name:     "pids_limit",
+		Help:     "Maximum number of processes and threads the container can have",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: pidsLimit,
+	},
+	{
+		Name:       "network_rx_bytes_total",
+		Help:       "Bytes received on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.RxBytes }),
+	},
+	{
+		Name:       "network_rx_packets_total",
+		Help:       "Packets received on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.RxPackets }),
+	},
+	{
+		Name:       "network_rx_errors_total",
+		Help:       "Receive errors on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.RxErrors }),
+	},
+	{
+		Name:       "network_rx_dropped_total",
+		Help:       "Incoming packets dropped on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.RxDropped }),
+	},
+	{
+		Name:       "network_tx_bytes_total",
+		Help:       "Bytes sent on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.TxBytes }),
+	},
+	{
+		Name:       "network_tx_packets_total",
+		Help:       "Packets sent on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.TxPackets }),
+	},
+	{
+		Name:       "network_tx_errors_total",
+		Help:       "Send errors on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.TxErrors }),
+	},
+	{
+		Name:       "network_tx_dropped_total",
+		Help:       "Outgoing packets dropped on the network interface",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.TxDropped }),
+	},
+	{
+		Name:       "blkio_bytes_total",
+		Help:       "Bytes transferred to and from the block device",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Device", "Op"},
+		ValuesFn:   blkioSamples(func(b types.BlkioStats) []types.BlkioStatEntry { return b.IoServiceBytesRecursive }),
+	},
+	{
+		Name:       "blkio_ops_total",
+		Help:       "I/O operations performed on the block device",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Device", "Op"},
+		ValuesFn:   blkioSamples(func(b types.BlkioStats) []types.BlkioStatEntry { return b.IoServicedRecursive }),
+	},
 }
 
-// StatsToMetrics converts docker's StatsJSON into constant Prometheus metrics
-func StatsToMetrics(stats types.StatsJSON, configs []MetricConfig, labels prometheus.Labels) ([]prometheus.Metric, error) {
-	metrics := []prometheus.Metric{}
+// PerCPUMetrics is a slice of metrics with a series per CPU core, which aren't included in DefaultMetrics because they can have high cardinality
+var PerCPUMetrics = []MetricConfig{
+	{
+		Name:       "cpu_seconds_per_core_total",
+		Help:       "CPU time consumed by the container on each CPU core",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"cpu"},
+		ValuesFn:   perCPUUsage,
+	},
+}
+
+// Desc declares the descriptor of the metric, with labelNames as variable labels ahead of its own LabelNames
+func (config MetricConfig) Desc(labelNames []string) *prometheus.Desc {
+	return prometheus.NewDesc(Prefix+config.Name, config.Help, appendLabelNames(labelNames, config.LabelNames), nil)
+}
+
+// ContainerMetrics converts containers into metrics, with descriptors declared once up front rather than for every container
+type ContainerMetrics struct {
+	configs []MetricConfig
+	descs   []*prometheus.Desc
+}
+
+// NewContainerMetrics declares the descriptors of configs, with labelNames as variable labels of every metric.
+// Their values are passed to ToMetrics.
+func NewContainerMetrics(configs []MetricConfig, labelNames []string) ContainerMetrics {
+	descs := make([]*prometheus.Desc, 0, len(configs))
 	for _, config := range configs {
-		m, err := prometheus.NewConstMetric(
-			prometheus.NewDesc(Prefix+config.Name, config.Help, nil /* variable labels */, labels),
-			config.Type,
-			config.ValueFn(stats),
-		)
+		descs = append(descs, config.Desc(labelNames))
+	}
+	return ContainerMetrics{configs: configs, descs: descs}
+}
+
+// Describe sends the descriptors of all the metrics
+func (m ContainerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range m.descs {
+		ch <- desc
+	}
+}
+
+// ToMetrics converts a container into constant Prometheus metrics.
+// labelValues are the values of the labelNames given to NewContainerMetrics, in the same order.
+func (m ContainerMetrics) ToMetrics(container Container, labelValues []string) ([]prometheus.Metric, error) {
+	metrics := []prometheus.Metric{}
+	for i, config := range m.configs {
+		var samples []Sample
+		if config.ValuesFn != nil {
+			samples = config.ValuesFn(container)
+		} else {
+			samples = []Sample{{Value: config.ValueFn(container)}}
+		}
+		ms, err := samplesToMetrics(m.descs[i], config.Type, labelValues, samples)
 		if err != nil {
-			// NewConstMetric can fail if variable labels are the wrong length (not applicable here) or Desc is invalid (shouldn't come up)
-			return nil, fmt.Errorf("prometheus.NewConstMetric(%s): %v", config.Name, err)
+			return nil, fmt.Errorf("converting %s: %v", config.Name, err)
+		}
+		metrics = append(metrics, ms...)
+	}
+	return metrics, nil
+}
+
+// appendLabelNames returns a new slice of labelNames followed by more, so neither is modified
+func appendLabelNames(labelNames, more []string) []string {
+	return append(append(make([]string, 0, len(labelNames)+len(more)), labelNames...), more...)
+}
+
+// samplesToMetrics creates a constant Prometheus metric for each sample, with labelValues ahead of the sample's own label values
+func samplesToMetrics(desc *prometheus.Desc, valueType prometheus.ValueType, labelValues []string, samples []Sample) ([]prometheus.Metric, error) {
+	metrics := make([]prometheus.Metric, 0, len(samples))
+	for _, sample := range samples {
+		m, err := prometheus.NewConstMetric(desc, valueType, sample.Value, appendLabelNames(labelValues, sample.LabelValues)...)
+		if err != nil {
+			// NewConstMetric can fail if variable labels are the wrong length or Desc is invalid (shouldn't come up)
+			return nil, fmt.Errorf("prometheus.NewConstMetric: %v", err)
 		}
 		metrics = append(metrics, m)
 	}
@@ -65,18 +363,188 @@ func StatsToMetrics(stats types.StatsJSON, configs []MetricConfig, labels promet
 }
 
 // cpuUsage returns the fraction from 0 to 1 of CPU time being used by the container.
-func cpuUsage(stats types.StatsJSON) float64 {
+func cpuUsage(c Container) float64 {
 	// On linux systems, docker reports CPU usage as nanoseconds of CPU time used since the container started. It also reports total system CPU nanoseconds.
 	// Ref: https://github.com/moby/moby/blob/master/api/types/stats.go
 	// When asking for stats, it gives two sets of those nanosecond totals, a newer one under stats.CPUStats and an older one under stats.PreCPUStats.
 	// (Pre is for previous. Where the previous data comes from I'm not sure.)
 	// Thus, we can calculate how much CPU each container is using as a fraction of the total CPU used on the host.
 	// All of these numbers are totals over all the CPUs on the system, so the number of CPUs doesn't come into play
-	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
-	containerDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(c.CPUStats.SystemUsage) - float64(c.PreCPUStats.SystemUsage)
+	containerDelta := float64(c.CPUStats.CPUUsage.TotalUsage) - float64(c.PreCPUStats.CPUUsage.TotalUsage)
 
 	if systemDelta > 0.0 && containerDelta > 0.0 {
 		return containerDelta / systemDelta
 	}
 	return 0.0
 }
+
+// cpuUsageVCPUs returns the number of vCPUs' worth of CPU time being used by the container.
+// Unlike cpuUsage, this doesn't depend on the size of the host.
+func cpuUsageVCPUs(c Container) float64 {
+	onlineCPUs := float64(c.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0.0 {
+		// Older docker versions don't report online CPUs. The docker CLI falls back to the number of per-CPU usage values in that case, so we do too.
+		onlineCPUs = float64(len(c.CPUStats.CPUUsage.PercpuUsage))
+	}
+	return cpuUsage(c) * onlineCPUs
+}
+
+// cpuLimitVCPUs returns the CPU limit of the container in vCPUs.
+// If the container doesn't have a CPU limit, it falls back to the task's limit, and if neither is set, ok is false.
+func cpuLimitVCPUs(c Container) (limit float64, ok bool) {
+	// A limit of 0 is how ECS reports that no limit was set for a container on EC2.
+	// Fargate reports Docker's minimum of 2 CPU shares instead, which isn't a real limit either.
+	if l := c.Metadata.Limits; l != nil && l.CPU != nil && *l.CPU > minCPUShares {
+		return *l.CPU / cpuUnitsPerVCPU, true
+	}
+	// Unlike container limits, task limits are reported in vCPUs (for example 0.25 on Fargate)
+	if l := c.Task.Limits; l != nil && l.CPU != nil && *l.CPU > 0.0 {
+		return *l.CPU, true
+	}
+	return 0.0, false
+}
+
+// cpuUtilizationOfLimit gives the CPU usage of the container as a ratio of its CPU limit, or no samples if there is no limit
+func cpuUtilizationOfLimit(c Container) []Sample {
+	limit, ok := cpuLimitVCPUs(c)
+	if !ok {
+		return nil
+	}
+	return []Sample{{Value: cpuUsageVCPUs(c) / limit}}
+}
+
+// perCPUUsage gives the CPU time used by the container on each CPU core, labeled by the index of the core.
+// Docker can report usage for more cores than are online, which will always be 0, so those are left out.
+func perCPUUsage(c Container) []Sample {
+	usage := c.CPUStats.CPUUsage.PercpuUsage
+	if online := int(c.CPUStats.OnlineCPUs); online > 0 && online < len(usage) {
+		usage = usage[:online]
+	}
+	samples := make([]Sample, 0, len(usage))
+	for cpu, ns := range usage {
+		samples = append(samples, Sample{
+			LabelValues: []string{strconv.Itoa(cpu)},
+			Value:       float64(ns) / nanosecondsPerSecond,
+		})
+	}
+	return samples
+}
+
+// cpuThrottledRatio returns the fraction from 0 to 1 of CPU enforcement periods in which the container was throttled.
+// Like cpuUsage, it's computed over the interval between PreCPUStats and CPUStats.
+func cpuThrottledRatio(c Container) float64 {
+	periodsDelta := float64(c.CPUStats.ThrottlingData.Periods) - float64(c.PreCPUStats.ThrottlingData.Periods)
+	throttledDelta := float64(c.CPUStats.ThrottlingData.ThrottledPeriods) - float64(c.PreCPUStats.ThrottlingData.ThrottledPeriods)
+
+	if periodsDelta > 0.0 && throttledDelta > 0.0 {
+		return throttledDelta / periodsDelta
+	}
+	return 0.0
+}
+
+// memStat returns a ValueFn giving the first of keys present in the memory.stat values reported by docker, or 0 if none are.
+// The keys differ between cgroup v1 and v2 (for example rss in v1 is anon in v2), so callers list all of the names a stat can have.
+// In cgroup v1, the total_ prefixed versions include any child cgroups, so they're preferred when present.
+func memStat(keys ...string) func(Container) float64 {
+	return func(c Container) float64 {
+		for _, key := range keys {
+			if v, ok := c.MemoryStats.Stats[key]; ok {
+				return float64(v)
+			}
+		}
+		return 0.0
+	}
+}
+
+// memWorkingSet returns the memory usage less inactive page cache, which is the same calculation cAdvisor uses for its working set metric.
+// This is closer to what the OOM killer considers than the raw usage, which includes page cache that can be reclaimed.
+func memWorkingSet(c Container) float64 {
+	usage := float64(c.MemoryStats.Usage)
+	inactiveFile := memStat("total_inactive_file", "inactive_file")(c)
+	if inactiveFile < usage {
+		return usage - inactiveFile
+	}
+	return 0.0
+}
+
+// declaredMemLimit gives the memory limit of the container from the task definition, or no samples if it doesn't have one.
+// This can differ from the cgroup limit docker reports, which on EC2 is the host's memory if only a soft limit (memoryReservation) was set.
+func declaredMemLimit(c Container) []Sample {
+	limit, ok := memLimitBytes(c.Metadata.Limits)
+	if !ok {
+		return nil
+	}
+	return []Sample{{Value: limit}}
+}
+
+// memUtilizationOfLimit gives the memory working set of the container as a ratio of its memory limit, or no samples if there is no limit.
+// Like cpuUtilizationOfLimit, if the container doesn't have a limit, it falls back to the task's limit.
+func memUtilizationOfLimit(c Container) []Sample {
+	limit, ok := memLimitBytes(c.Metadata.Limits)
+	if !ok {
+		limit, ok = memLimitBytes(c.Task.Limits)
+	}
+	if !ok {
+		return nil
+	}
+	return []Sample{{Value: memWorkingSet(c) / limit}}
+}
+
+// memLimitBytes converts ECS's memory limit in MiB to bytes. If no limit is set, ok is false.
+func memLimitBytes(l *data.Limits) (limit float64, ok bool) {
+	// A limit of 0 is how ECS reports that no limit was set for a container
+	if l == nil || l.Memory == nil || *l.Memory == 0 {
+		return 0.0, false
+	}
+	return float64(*l.Memory) * bytesPerMiB, true
+}
+
+// pidsLimit gives the limit on the number of pids in the container, or no samples if there is no limit
+func pidsLimit(c Container) []Sample {
+	// Docker reports a limit of 0 if there is no limit
+	if c.PidsStats.Limit == 0 {
+		return nil
+	}
+	return []Sample{{Value: float64(c.PidsStats.Limit)}}
+}
+
+// networkSamples returns a ValuesFn giving one sample per network interface, labeled by the interface name.
+// Docker reports these as totals since the interface was created, so they're suitable for counters.
+func networkSamples(valueFn func(types.NetworkStats) uint64) func(Container) []Sample {
+	return func(c Container) []Sample {
+		interfaces := make([]string, 0, len(c.Networks))
+		for iface := range c.Networks {
+			interfaces = append(interfaces, iface)
+		}
+		// Sort so the output doesn't depend on map iteration order
+		sort.Strings(interfaces)
+
+		samples := make([]Sample, 0, len(interfaces))
+		for _, iface := range interfaces {
+			samples = append(samples, Sample{
+				LabelValues: []string{iface},
+				Value:       float64(valueFn(c.Networks[iface])),
+			})
+		}
+		return samples
+	}
+}
+
+// blkioSamples returns a ValuesFn giving one sample per block device and operation, labeled by the device's major:minor number and the operation.
+// The "Total" entries are skipped since they're just the sum of Read and Write (or equivalently Sync and Async) and can be computed in a query.
+func blkioSamples(entriesFn func(types.BlkioStats) []types.BlkioStatEntry) func(Container) []Sample {
+	return func(c Container) []Sample {
+		samples := []Sample{}
+		for _, entry := range entriesFn(c.BlkioStats) {
+			if strings.EqualFold(entry.Op, "Total") {
+				continue
+			}
+			samples = append(samples, Sample{
+				LabelValues: []string{fmt.Sprintf("%d:%d", entry.Major, entry.Minor), entry.Op},
+				Value:       float64(entry.Value),
+			})
+		}
+		return samples
+	}
+}
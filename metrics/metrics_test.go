@@ -3,11 +3,17 @@ package metrics
 import (
 	"testing"
 
-	"github.com/docker/engine/api/types"
+	"github.com/docker/docker/api/types"
+	"github.com/go-openapi/swag"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/Clever/ecs-task-metadata-exporter/data"
 )
 
 func Test_CpuUsage(t *testing.T) {
-	stats := types.StatsJSON{Stats: types.Stats{
+	c := Container{StatsJSON: types.StatsJSON{Stats: types.Stats{
 		CPUStats: types.CPUStats{
 			SystemUsage: 100,
 			CPUUsage: types.CPUUsage{
@@ -20,11 +26,251 @@ func Test_CpuUsage(t *testing.T) {
 				TotalUsage: 20,
 			},
 		},
-	}}
-	usage := cpuUsage(stats)
+	}}}
+	usage := cpuUsage(c)
 	// out of the 20 total system CPU seconds between previous and current, 10 were used by the container; thus we expect 10.0/20.0 = 0.5
 	if usage != 0.5 {
 		t.Fatalf("Got CPU usage %f; expecting %f", usage, 0.5)
 	}
 
 }
+
+func Test_CpuUtilizationOfLimit(t *testing.T) {
+	// 2 of the 4 host CPUs are in use
+	stats := types.StatsJSON{Stats: types.Stats{
+		CPUStats: types.CPUStats{
+			SystemUsage: 100,
+			OnlineCPUs:  4,
+			CPUUsage:    types.CPUUsage{TotalUsage: 70},
+		},
+		PreCPUStats: types.CPUStats{
+			SystemUsage: 80,
+			CPUUsage:    types.CPUUsage{TotalUsage: 60},
+		},
+	}}
+	for _, tc := range []struct {
+		name           string
+		containerLimit *data.Limits
+		taskLimit      *data.Limits
+		expected       []Sample
+	}{
+		{
+			name:           "container limit in CPU units",
+			containerLimit: &data.Limits{CPU: swag.Float64(2048)},
+			taskLimit:      &data.Limits{CPU: swag.Float64(8)},
+			expected:       []Sample{{Value: 1.0}},
+		},
+		{
+			name:           "falls back to task limit in vCPUs",
+			containerLimit: &data.Limits{CPU: swag.Float64(0)},
+			taskLimit:      &data.Limits{CPU: swag.Float64(4)},
+			expected:       []Sample{{Value: 0.5}},
+		},
+		{
+			name:           "falls back to task limit on Fargate",
+			containerLimit: &data.Limits{CPU: swag.Float64(2)},
+			taskLimit:      &data.Limits{CPU: swag.Float64(4)},
+			expected:       []Sample{{Value: 0.5}},
+		},
+		{
+			name:     "no limits",
+			expected: nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Container{
+				StatsJSON: stats,
+				Metadata:  data.ContainerMetadata{Limits: tc.containerLimit},
+				Task:      data.TaskMetadata{Limits: tc.taskLimit},
+			}
+			if diff := cmp.Diff(tc.expected, cpuUtilizationOfLimit(c)); diff != "" {
+				t.Fatalf("CPU utilization mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_PerCPUUsage(t *testing.T) {
+	c := Container{StatsJSON: types.StatsJSON{Stats: types.Stats{
+		CPUStats: types.CPUStats{
+			OnlineCPUs: 2,
+			CPUUsage: types.CPUUsage{
+				PercpuUsage: []uint64{3000000000, 500000000, 0, 0},
+			},
+		},
+	}}}
+	// Only the 2 online CPUs should be included
+	expected := []Sample{
+		{LabelValues: []string{"0"}, Value: 3},
+		{LabelValues: []string{"1"}, Value: 0.5},
+	}
+	if diff := cmp.Diff(expected, perCPUUsage(c)); diff != "" {
+		t.Fatalf("per-CPU usage mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_CpuThrottledRatio(t *testing.T) {
+	c := Container{StatsJSON: types.StatsJSON{Stats: types.Stats{
+		CPUStats: types.CPUStats{
+			ThrottlingData: types.ThrottlingData{Periods: 150, ThrottledPeriods: 40},
+		},
+		PreCPUStats: types.CPUStats{
+			ThrottlingData: types.ThrottlingData{Periods: 100, ThrottledPeriods: 30},
+		},
+	}}}
+	ratio := cpuThrottledRatio(c)
+	// 10 of the 50 periods between previous and current were throttled; thus we expect 10.0/50.0 = 0.2
+	if ratio != 0.2 {
+		t.Fatalf("Got CPU throttled ratio %f; expecting %f", ratio, 0.2)
+	}
+}
+
+func Test_MemWorkingSet(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stats    map[string]uint64
+		expected float64
+	}{
+		{name: "cgroup v1", stats: map[string]uint64{"inactive_file": 3000, "total_inactive_file": 4000}, expected: 6000},
+		{name: "cgroup v2", stats: map[string]uint64{"inactive_file": 3000, "file": 5000}, expected: 7000},
+		{name: "no inactive_file", stats: map[string]uint64{}, expected: 10000},
+		{name: "inactive_file larger than usage", stats: map[string]uint64{"inactive_file": 20000}, expected: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Container{StatsJSON: types.StatsJSON{Stats: types.Stats{
+				MemoryStats: types.MemoryStats{Usage: 10000, Stats: tc.stats},
+			}}}
+			if ws := memWorkingSet(c); ws != tc.expected {
+				t.Fatalf("Got working set %f; expecting %f", ws, tc.expected)
+			}
+		})
+	}
+}
+
+func Test_MemUtilizationOfLimit(t *testing.T) {
+	c := Container{
+		StatsJSON: types.StatsJSON{Stats: types.Stats{
+			MemoryStats: types.MemoryStats{Usage: 128 * 1024 * 1024},
+		}},
+		Metadata: data.ContainerMetadata{Limits: &data.Limits{Memory: swag.Uint64(0)}},
+		Task:     data.TaskMetadata{Limits: &data.Limits{Memory: swag.Uint64(512)}},
+	}
+	// The container has no limit, so it should use the task's
+	if diff := cmp.Diff([]Sample(nil), declaredMemLimit(c)); diff != "" {
+		t.Fatalf("declared memory limit mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Sample{{Value: 0.25}}, memUtilizationOfLimit(c)); diff != "" {
+		t.Fatalf("memory utilization mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_PidsLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		limit    uint64
+		expected []Sample
+	}{
+		{name: "limited", limit: 4096, expected: []Sample{{Value: 4096}}},
+		{name: "no limit", limit: 0, expected: nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Container{StatsJSON: types.StatsJSON{Stats: types.Stats{
+				PidsStats: types.PidsStats{Current: 12, Limit: tc.limit},
+			}}}
+			if diff := cmp.Diff(tc.expected, pidsLimit(c)); diff != "" {
+				t.Fatalf("pids limit mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_NetworkSamples(t *testing.T) {
+	c := Container{StatsJSON: types.StatsJSON{Networks: map[string]types.NetworkStats{
+		"eth1": {RxBytes: 100, TxBytes: 10},
+		"eth0": {RxBytes: 200, TxBytes: 20},
+	}}}
+	samples := networkSamples(func(n types.NetworkStats) uint64 { return n.RxBytes })(c)
+	expected := []Sample{
+		{LabelValues: []string{"eth0"}, Value: 200},
+		{LabelValues: []string{"eth1"}, Value: 100},
+	}
+	if diff := cmp.Diff(expected, samples); diff != "" {
+		t.Fatalf("network samples mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_BlkioSamples(t *testing.T) {
+	c := Container{StatsJSON: types.StatsJSON{Stats: types.Stats{
+		BlkioStats: types.BlkioStats{
+			IoServiceBytesRecursive: []types.BlkioStatEntry{
+				{Major: 202, Minor: 26368, Op: "Read", Value: 3452928},
+				{Major: 202, Minor: 26368, Op: "Write", Value: 10},
+				{Major: 202, Minor: 26368, Op: "Total", Value: 3452938},
+			},
+		},
+	}}}
+	samples := blkioSamples(func(b types.BlkioStats) []types.BlkioStatEntry { return b.IoServiceBytesRecursive })(c)
+	// The Total row should be skipped
+	expected := []Sample{
+		{LabelValues: []string{"202:26368", "Read"}, Value: 3452928},
+		{LabelValues: []string{"202:26368", "Write"}, Value: 10},
+	}
+	if diff := cmp.Diff(expected, samples); diff != "" {
+		t.Fatalf("blkio samples mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ContainerMetrics(t *testing.T) {
+	configs := []MetricConfig{
+		{
+			Name:    "mem_usage_bytes",
+			Help:    "Current memory usage",
+			Type:    prometheus.GaugeValue,
+			ValueFn: func(c Container) float64 { return float64(c.MemoryStats.Usage) },
+		},
+		{
+			Name:       "network_rx_bytes_total",
+			Help:       "Bytes received on the network interface",
+			Type:       prometheus.CounterValue,
+			LabelNames: []string{"Interface"},
+			ValuesFn:   networkSamples(func(n types.NetworkStats) uint64 { return n.RxBytes }),
+		},
+	}
+	m := NewContainerMetrics(configs, []string{"ContainerName", "Team"})
+
+	descs := make(chan *prometheus.Desc, 10)
+	m.Describe(descs)
+	close(descs)
+	if len(descs) != len(configs) {
+		t.Fatalf("got %d descriptors; expecting %d", len(descs), len(configs))
+	}
+
+	c := Container{StatsJSON: types.StatsJSON{
+		Stats:    types.Stats{MemoryStats: types.MemoryStats{Usage: 100}},
+		Networks: map[string]types.NetworkStats{"eth0": {RxBytes: 200}},
+	}}
+	metrics, err := m.ToMetrics(c, []string{"app", ""})
+	if err != nil {
+		t.Fatalf("got error from ToMetrics(): %v", err)
+	}
+	// The common label values come before the metric's own
+	expected := [][]string{
+		{"ContainerName=app", "Team="},
+		{"ContainerName=app", "Interface=eth0", "Team="},
+	}
+	got := [][]string{}
+	for _, metric := range metrics {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			t.Fatalf("got error writing metric: %v", err)
+		}
+		labels := []string{}
+		for _, pair := range pb.Label {
+			labels = append(labels, pair.GetName()+"="+pair.GetValue())
+		}
+		got = append(got, labels)
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Fatalf("labels mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,325 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Clever/ecs-task-metadata-exporter/data"
+)
+
+// TaskPrefix will be prepended to metrics about the task as a whole, rather than any single container
+const TaskPrefix = "ecs_task_"
+
+// clockSyncStatuses are the statuses ECS reports for the synchronization of a task's clock
+var clockSyncStatuses = []string{"SYNCHRONIZED", "NOT_SYNCHRONIZED"}
+
+// Task is everything known about a task at scrape time: its ECS metadata, plus the docker stats of its containers keyed by DockerID
+type Task struct {
+	Metadata data.TaskMetadata
+	Stats    map[string]types.StatsJSON
+}
+
+// TaskMetricConfig is a specification of a single metric that can be extracted from a task's ECS metadata and container stats.
+// Like MetricConfig, exactly one of ValueFn or ValuesFn should be set.
+type TaskMetricConfig struct {
+	Name       string
+	Help       string
+	Type       prometheus.ValueType
+	ValueFn    func(Task) float64
+	LabelNames []string
+	ValuesFn   func(Task) []Sample
+}
+
+// DefaultTaskMetrics is a slice of default task-level metrics to use
+var DefaultTaskMetrics = []TaskMetricConfig{
+	{
+		Name: "mem_limit_bytes",
+		Help: "Memory limit of the task from the ECS task definition",
+		Type: prometheus.GaugeValue,
+		ValuesFn: func(t Task) []Sample {
+			limit, ok := memLimitBytes(t.Metadata.Limits)
+			if !ok {
+				return nil
+			}
+			return []Sample{{Value: limit}}
+		},
+	},
+	{
+		Name:       "status",
+		Help:       "1 for the task's current known and desired status, and 0 for every other status",
+		Type:       prometheus.GaugeValue,
+		LabelNames: []string{"Status", "StatusType"},
+		ValuesFn:   func(t Task) []Sample { return statusSet(t.Metadata.KnownStatus, t.Metadata.DesiredStatus) },
+	},
+	{
+		Name:       "info",
+		Help:       "Always 1, with labels describing how and where the task is running",
+		Type:       prometheus.GaugeValue,
+		LabelNames: []string{"LaunchType", "PlatformFamily", "PlatformVersion", "ServiceName", "VPCID"},
+		ValuesFn: func(t Task) []Sample {
+			return []Sample{{
+				LabelValues: []string{t.Metadata.LaunchType, t.Metadata.PlatformFamily, t.Metadata.PlatformVersion, t.Metadata.ServiceName, t.Metadata.VPCID},
+				Value:       1.0,
+			}}
+		},
+	},
+	{
+		Name:     "image_pull_duration_seconds",
+		Help:     "Time taken to pull the container images of the task",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: imagePullDuration,
+	},
+	{
+		Name:     "ephemeral_storage_used_bytes",
+		Help:     "Ephemeral storage used by the task",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: ephemeralStorage(func(e data.EphemeralStorageMetrics) uint64 { return e.Utilized }),
+	},
+	{
+		Name:     "ephemeral_storage_reserved_bytes",
+		Help:     "Ephemeral storage available to the task",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: ephemeralStorage(func(e data.EphemeralStorageMetrics) uint64 { return e.Reserved }),
+	},
+	{
+		Name:     "clock_error_bound_seconds",
+		Help:     "Bound on the error of the task's clock, as measured by Amazon Time Sync Service",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: clockErrorBound,
+	},
+	{
+		Name:       "clock_sync_status",
+		Help:       "1 for the current synchronization status of the task's clock, and 0 for every other status",
+		Type:       prometheus.GaugeValue,
+		LabelNames: []string{"Status"},
+		ValuesFn:   clockSyncStatus,
+	},
+	{
+		Name:    "mem_usage_bytes",
+		Help:    "Current memory usage, summed over the containers in the task",
+		Type:    prometheus.GaugeValue,
+		ValueFn: sumContainers(func(c Container) float64 { return float64(c.MemoryStats.Usage) }),
+	},
+	{
+		Name:    "mem_working_set_bytes",
+		Help:    "Memory usage minus inactive page cache, summed over the containers in the task",
+		Type:    prometheus.GaugeValue,
+		ValueFn: sumContainers(memWorkingSet),
+	},
+	{
+		Name:     "mem_utilization_of_limit",
+		Help:     "Memory working set of the task as a ratio of its ECS memory limit",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: taskMemUtilizationOfLimit,
+	},
+	{
+		Name:    "cpu_usage_vcpus",
+		Help:    "Number of vCPUs' worth of CPU time being used, summed over the containers in the task",
+		Type:    prometheus.GaugeValue,
+		ValueFn: sumContainers(cpuUsageVCPUs),
+	},
+	{
+		Name:     "cpu_utilization_of_limit",
+		Help:     "CPU usage of the task as a ratio of its ECS CPU limit",
+		Type:     prometheus.GaugeValue,
+		ValuesFn: taskCPUUtilizationOfLimit,
+	},
+	{
+		Name:    "cpu_seconds_total",
+		Help:    "Total CPU time consumed, summed over the containers in the task",
+		Type:    prometheus.CounterValue,
+		ValueFn: sumContainers(func(c Container) float64 { return float64(c.CPUStats.CPUUsage.TotalUsage) / nanosecondsPerSecond }),
+	},
+	{
+		Name:       "network_rx_bytes_total",
+		Help:       "Bytes received on the network interface by the containers in the task",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   taskNetworkSamples(func(n types.NetworkStats) uint64 { return n.RxBytes }),
+	},
+	{
+		Name:       "network_tx_bytes_total",
+		Help:       "Bytes sent on the network interface by the containers in the task",
+		Type:       prometheus.CounterValue,
+		LabelNames: []string{"Interface"},
+		ValuesFn:   taskNetworkSamples(func(n types.NetworkStats) uint64 { return n.TxBytes }),
+	},
+}
+
+// Desc declares the descriptor of the metric, with labelNames as variable labels ahead of its own LabelNames
+func (config TaskMetricConfig) Desc(labelNames []string) *prometheus.Desc {
+	return prometheus.NewDesc(TaskPrefix+config.Name, config.Help, appendLabelNames(labelNames, config.LabelNames), nil)
+}
+
+// TaskMetrics converts tasks into metrics, with descriptors declared once up front rather than for every scrape
+type TaskMetrics struct {
+	configs []TaskMetricConfig
+	descs   []*prometheus.Desc
+}
+
+// NewTaskMetrics declares the descriptors of configs, with labelNames as variable labels of every metric.
+// Their values are passed to ToMetrics.
+func NewTaskMetrics(configs []TaskMetricConfig, labelNames []string) TaskMetrics {
+	descs := make([]*prometheus.Desc, 0, len(configs))
+	for _, config := range configs {
+		descs = append(descs, config.Desc(labelNames))
+	}
+	return TaskMetrics{configs: configs, descs: descs}
+}
+
+// Describe sends the descriptors of all the metrics
+func (m TaskMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range m.descs {
+		ch <- desc
+	}
+}
+
+// ToMetrics converts a task's ECS metadata and container stats into constant Prometheus metrics.
+// labelValues are the values of the labelNames given to NewTaskMetrics, in the same order.
+func (m TaskMetrics) ToMetrics(task Task, labelValues []string) ([]prometheus.Metric, error) {
+	metrics := []prometheus.Metric{}
+	for i, config := range m.configs {
+		var samples []Sample
+		if config.ValuesFn != nil {
+			samples = config.ValuesFn(task)
+		} else {
+			samples = []Sample{{Value: config.ValueFn(task)}}
+		}
+		ms, err := samplesToMetrics(m.descs[i], config.Type, labelValues, samples)
+		if err != nil {
+			return nil, fmt.Errorf("converting %s: %v", config.Name, err)
+		}
+		metrics = append(metrics, ms...)
+	}
+	return metrics, nil
+}
+
+// Containers returns the containers of the task that are part of the task definition and have stats.
+// Containers that ECS runs internally (for example the pause container used for awsvpc networking) are excluded.
+func (t Task) Containers() []Container {
+	containers := []Container{}
+	for _, meta := range t.Metadata.Containers {
+		if meta.Type != "NORMAL" {
+			continue
+		}
+		stats, ok := t.Stats[meta.DockerID]
+		if !ok {
+			continue
+		}
+		containers = append(containers, Container{StatsJSON: stats, Metadata: meta, Task: t.Metadata})
+	}
+	return containers
+}
+
+// imagePullDuration gives the time between the task starting and finishing pulling its images, or no samples if that isn't known
+func imagePullDuration(t Task) []Sample {
+	if t.Metadata.PullStartedAt.IsZero() || t.Metadata.PullStoppedAt.IsZero() {
+		return nil
+	}
+	return []Sample{{Value: t.Metadata.PullStoppedAt.Sub(t.Metadata.PullStartedAt).Seconds()}}
+}
+
+// ephemeralStorage returns a task ValuesFn giving the result of valueFn in bytes, or no samples if the task has no ephemeral storage metrics
+func ephemeralStorage(valueFn func(data.EphemeralStorageMetrics) uint64) func(Task) []Sample {
+	return func(t Task) []Sample {
+		if t.Metadata.EphemeralStorageMetrics == nil {
+			return nil
+		}
+		return []Sample{{Value: float64(valueFn(*t.Metadata.EphemeralStorageMetrics)) * bytesPerMiB}}
+	}
+}
+
+// clockErrorBound gives the clock error bound of the task in seconds, or no samples if it isn't known
+func clockErrorBound(t Task) []Sample {
+	if t.Metadata.ClockDrift == nil {
+		return nil
+	}
+	return []Sample{{Value: t.Metadata.ClockDrift.ClockErrorBound / 1000.0}}
+}
+
+// clockSyncStatus gives a state-set of clock synchronization statuses labeled by Status, or no samples if it isn't known
+func clockSyncStatus(t Task) []Sample {
+	if t.Metadata.ClockDrift == nil {
+		return nil
+	}
+	return stateSet(clockSyncStatuses, t.Metadata.ClockDrift.ClockSynchronizationStatus)
+}
+
+// sumContainers returns a task ValueFn giving the sum of valueFn over the task's containers
+func sumContainers(valueFn func(Container) float64) func(Task) float64 {
+	return func(t Task) float64 {
+		sum := 0.0
+		for _, c := range t.Containers() {
+			sum += valueFn(c)
+		}
+		return sum
+	}
+}
+
+// taskMemUtilizationOfLimit gives the memory working set of the task as a ratio of its memory limit, or no samples if it doesn't have one
+func taskMemUtilizationOfLimit(t Task) []Sample {
+	limit, ok := memLimitBytes(t.Metadata.Limits)
+	if !ok {
+		return nil
+	}
+	return []Sample{{Value: sumContainers(memWorkingSet)(t) / limit}}
+}
+
+// taskCPUUtilizationOfLimit gives the CPU usage of the task as a ratio of its CPU limit, or no samples if it doesn't have one
+func taskCPUUtilizationOfLimit(t Task) []Sample {
+	// Task limits are reported in vCPUs, unlike container limits which are in CPU units
+	if l := t.Metadata.Limits; l == nil || l.CPU == nil || *l.CPU <= 0.0 {
+		return nil
+	}
+	return []Sample{{Value: sumContainers(cpuUsageVCPUs)(t) / *t.Metadata.Limits.CPU}}
+}
+
+// taskNetworkSamples returns a task ValuesFn giving one sample per network interface, combined over the task's containers.
+// In awsvpc and host network modes, all the containers share one network namespace, so they each report the same interface stats.
+// Summing those would count the traffic once per container, so in that case we take the largest value reported for each interface instead.
+func taskNetworkSamples(valueFn func(types.NetworkStats) uint64) func(Task) []Sample {
+	return func(t Task) []Sample {
+		shared := sharesNetworkNamespace(t.Metadata)
+		totals := map[string]uint64{}
+		for _, c := range t.Containers() {
+			for iface, stats := range c.Networks {
+				v := valueFn(stats)
+				if !shared {
+					totals[iface] += v
+				} else if v > totals[iface] {
+					totals[iface] = v
+				}
+			}
+		}
+
+		interfaces := make([]string, 0, len(totals))
+		for iface := range totals {
+			interfaces = append(interfaces, iface)
+		}
+		sort.Strings(interfaces)
+
+		samples := make([]Sample, 0, len(interfaces))
+		for _, iface := range interfaces {
+			samples = append(samples, Sample{
+				LabelValues: []string{iface},
+				Value:       float64(totals[iface]),
+			})
+		}
+		return samples
+	}
+}
+
+// sharesNetworkNamespace reports whether the containers of the task all share a network namespace
+func sharesNetworkNamespace(meta data.TaskMetadata) bool {
+	for _, c := range meta.Containers {
+		for _, n := range c.Networks {
+			if n.NetworkMode == "awsvpc" || n.NetworkMode == "host" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/Clever/ecs-task-metadata-exporter/data"
+)
+
+func Test_TaskNetworkSamples(t *testing.T) {
+	stats := map[string]types.StatsJSON{
+		"a": {Networks: map[string]types.NetworkStats{"eth0": {RxBytes: 100}}},
+		"b": {Networks: map[string]types.NetworkStats{"eth0": {RxBytes: 110}}},
+		// Internal ECS containers shouldn't be counted
+		"pause": {Networks: map[string]types.NetworkStats{"eth0": {RxBytes: 1000}}},
+	}
+	for _, tc := range []struct {
+		networkMode string
+		expected    []Sample
+	}{
+		// Each container has its own namespace, so their traffic is summed
+		{networkMode: "bridge", expected: []Sample{{LabelValues: []string{"eth0"}, Value: 210}}},
+		// The containers share a namespace, so they all report (roughly) the same totals
+		{networkMode: "awsvpc", expected: []Sample{{LabelValues: []string{"eth0"}, Value: 110}}},
+	} {
+		t.Run(tc.networkMode, func(t *testing.T) {
+			networks := []data.Network{{NetworkMode: tc.networkMode}}
+			task := Task{
+				Metadata: data.TaskMetadata{Containers: []data.ContainerMetadata{
+					{DockerID: "a", Type: "NORMAL", Networks: networks},
+					{DockerID: "b", Type: "NORMAL", Networks: networks},
+					{DockerID: "pause", Type: "CNI_PAUSE", Networks: networks},
+				}},
+				Stats: stats,
+			}
+			samples := taskNetworkSamples(func(n types.NetworkStats) uint64 { return n.RxBytes })(task)
+			if diff := cmp.Diff(tc.expected, samples); diff != "" {
+				t.Fatalf("task network samples mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_EphemeralStorage(t *testing.T) {
+	// As reported by v4 of the task metadata endpoint on Fargate platform version 1.4.0 and later
+	var meta data.TaskMetadata
+	if err := json.Unmarshal([]byte(`{"EphemeralStorageMetrics": {"Utilized": 221, "Reserved": 20496}}`), &meta); err != nil {
+		t.Fatalf("unmarshaling task metadata: %v", err)
+	}
+	task := Task{Metadata: meta}
+	used := ephemeralStorage(func(e data.EphemeralStorageMetrics) uint64 { return e.Utilized })
+	reserved := ephemeralStorage(func(e data.EphemeralStorageMetrics) uint64 { return e.Reserved })
+	if diff := cmp.Diff([]Sample{{Value: 221 * 1024 * 1024}}, used(task)); diff != "" {
+		t.Fatalf("ephemeral storage used mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Sample{{Value: 20496 * 1024 * 1024}}, reserved(task)); diff != "" {
+		t.Fatalf("ephemeral storage reserved mismatch (-want +got):\n%s", diff)
+	}
+
+	// Tasks on EC2 or older Fargate platform versions don't report it
+	if samples := used(Task{}); samples != nil {
+		t.Fatalf("got samples %v without ephemeral storage metrics; expecting none", samples)
+	}
+}
+
+func Test_ClockDrift(t *testing.T) {
+	task := Task{Metadata: data.TaskMetadata{ClockDrift: &data.ClockDrift{
+		ClockErrorBound:            0.5,
+		ClockSynchronizationStatus: "NOT_SYNCHRONIZED",
+	}}}
+	if diff := cmp.Diff([]Sample{{Value: 0.0005}}, clockErrorBound(task)); diff != "" {
+		t.Fatalf("clock error bound mismatch (-want +got):\n%s", diff)
+	}
+	expectedStatus := []Sample{
+		{LabelValues: []string{"SYNCHRONIZED"}, Value: 0},
+		{LabelValues: []string{"NOT_SYNCHRONIZED"}, Value: 1},
+	}
+	if diff := cmp.Diff(expectedStatus, clockSyncStatus(task)); diff != "" {
+		t.Fatalf("clock sync status mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_TaskInfo(t *testing.T) {
+	var info TaskMetricConfig
+	for _, config := range DefaultTaskMetrics {
+		if config.Name == "info" {
+			info = config
+		}
+	}
+	task := Task{Metadata: data.TaskMetadata{
+		LaunchType:      "FARGATE",
+		PlatformFamily:  "Linux",
+		PlatformVersion: "1.4.0",
+		ServiceName:     "nginx-service",
+		VPCID:           "vpc-1234567890abcdef0",
+	}}
+	expected := []Sample{{LabelValues: []string{"FARGATE", "Linux", "1.4.0", "nginx-service", "vpc-1234567890abcdef0"}, Value: 1}}
+	if diff := cmp.Diff(expected, info.ValuesFn(task)); diff != "" {
+		t.Fatalf("task info mismatch (-want +got):\n%s", diff)
+	}
+	// Without v4, the labels are empty, but the metric is still reported
+	expected = []Sample{{LabelValues: []string{"", "", "", "", ""}, Value: 1}}
+	if diff := cmp.Diff(expected, info.ValuesFn(Task{})); diff != "" {
+		t.Fatalf("task info without v4 fields mismatch (-want +got):\n%s", diff)
+	}
+}